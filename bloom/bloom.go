@@ -0,0 +1,201 @@
+// Package bloom reads and writes the Bloom filters passdb exports so leaked
+// passwords can be checked offline.
+//
+// A filter file is laid out as follows, with integers in big-endian order:
+//
+//	offset  size  field
+//	0       4     magic "PDBF"
+//	4       1     format version, currently 1
+//	5       1     k, the number of hash functions
+//	6       2     reserved, zero
+//	8       8     m, the number of bits in the filter
+//	16      8     n, the number of passwords added
+//	24      m/8   bit array, rounded up to a whole byte; bit i is stored in
+//	              byte i/8 under the mask 1<<(i%8)
+//
+// Passwords are added by the SHA1 of their UTF-8 bytes. With h1 and h2 the
+// first and second big-endian uint64 of the digest, and h2 forced odd, the
+// bits set for a password are (h1 + i*h2) mod m for i in [0, k).
+package bloom
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Magic identifies a passdb Bloom filter file
+const Magic = "PDBF"
+
+// Version of the file format written by this package
+const Version = 1
+
+const headerSize = 24
+
+// MaxBits is the largest filter New creates and Read accepts, 512 MiB of bits
+const MaxBits = 1 << 32
+
+// ErrFormat is returned when reading a file that isn't a passdb filter
+var ErrFormat = errors.New("bloom: not a passdb filter file")
+
+// Filter is a Bloom filter of SHA1 password digests
+type Filter struct {
+	k    uint8
+	m    uint64
+	n    uint64
+	bits []byte
+}
+
+// New returns an empty filter sized to hold n passwords with a false positive
+// rate of about fpRate. Filters are never larger than MaxBits, so the rate
+// ends up higher when that isn't enough.
+func New(n uint64, fpRate float64) *Filter {
+	if n == 0 {
+		n = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.001
+	}
+
+	m := uint64(math.Min(
+		math.Ceil(-float64(n)*math.Log(fpRate)/(math.Ln2*math.Ln2)),
+		MaxBits,
+	))
+	k := math.Round(float64(m) / float64(n) * math.Ln2)
+	k = math.Max(1, math.Min(k, math.MaxUint8))
+
+	return &Filter{
+		k:    uint8(k),
+		m:    m,
+		bits: make([]byte, (m+7)/8),
+	}
+}
+
+// Add adds password to the filter
+func (f *Filter) Add(password string) {
+	f.AddSHA1(sha1.Sum([]byte(password)))
+}
+
+// AddSHA1 adds a password by its SHA1 digest
+func (f *Filter) AddSHA1(sum [sha1.Size]byte) {
+	h1, h2 := split(sum)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+	f.n++
+}
+
+// Contains reports whether password may have been added to the filter. False
+// positives are possible, false negatives are not.
+func (f *Filter) Contains(password string) bool {
+	return f.ContainsSHA1(sha1.Sum([]byte(password)))
+}
+
+// ContainsSHA1 reports whether a password with the given SHA1 digest may have
+// been added to the filter
+func (f *Filter) ContainsSHA1(sum [sha1.Size]byte) bool {
+	h1, h2 := split(sum)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Count returns the number of passwords added to the filter
+func (f *Filter) Count() uint64 {
+	return f.n
+}
+
+// FalsePositiveRate estimates the filter's false positive rate given the
+// number of passwords added so far
+func (f *Filter) FalsePositiveRate() float64 {
+	k := float64(f.k)
+	return math.Pow(1-math.Exp(-k*float64(f.n)/float64(f.m)), k)
+}
+
+// WriteTo writes the filter to w in the passdb filter file format
+func (f *Filter) WriteTo(w io.Writer) (int64, error) {
+	header := make([]byte, headerSize)
+	copy(header, Magic)
+	header[4] = Version
+	header[5] = f.k
+	binary.BigEndian.PutUint64(header[8:], f.m)
+	binary.BigEndian.PutUint64(header[16:], f.n)
+
+	written, err := w.Write(header)
+	if err != nil {
+		return int64(written), err
+	}
+	n, err := w.Write(f.bits)
+	return int64(written + n), err
+}
+
+// Read reads a filter in the passdb filter file format from r
+func Read(r io.Reader) (*Filter, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != Magic {
+		return nil, ErrFormat
+	}
+	if header[4] != Version {
+		return nil, fmt.Errorf("bloom: unsupported format version %d", header[4])
+	}
+
+	f := &Filter{
+		k: header[5],
+		m: binary.BigEndian.Uint64(header[8:]),
+		n: binary.BigEndian.Uint64(header[16:]),
+	}
+	if f.k == 0 || f.m == 0 || f.m > MaxBits {
+		return nil, ErrFormat
+	}
+
+	f.bits = make([]byte, (f.m+7)/8)
+	if _, err := io.ReadFull(r, f.bits); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Open reads the filter file at path, checking its size against the size of
+// filter its header describes before reading it
+func Open(path string) (*Filter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, err
+	}
+	m := binary.BigEndian.Uint64(header[8:])
+	if m > MaxBits || info.Size() != headerSize+int64((m+7)/8) {
+		return nil, ErrFormat
+	}
+
+	return Read(bufio.NewReader(io.MultiReader(bytes.NewReader(header), file)))
+}
+
+func split(sum [sha1.Size]byte) (h1, h2 uint64) {
+	h1 = binary.BigEndian.Uint64(sum[0:8])
+	h2 = binary.BigEndian.Uint64(sum[8:16]) | 1
+	return
+}
@@ -0,0 +1,157 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testFilter(n int, fpRate float64) *Filter {
+	filter := New(uint64(n), fpRate)
+	for i := range n {
+		filter.Add(fmt.Sprintf("password%d", i))
+	}
+	return filter
+}
+
+func TestRoundTrip(t *testing.T) {
+	filter := testFilter(1000, 0.01)
+	var buf bytes.Buffer
+	written, err := filter.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(buf.Len()) || written != headerSize+int64(len(filter.bits)) {
+		t.Errorf("wrote %d bytes, buffer has %d", written, buf.Len())
+	}
+	header := buf.Bytes()[:headerSize]
+	if string(header[:4]) != Magic || header[4] != Version || header[5] != filter.k {
+		t.Errorf("header = %x", header)
+	}
+
+	read, err := Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.k != filter.k || read.m != filter.m || read.Count() != 1000 || !bytes.Equal(read.bits, filter.bits) {
+		t.Errorf("read k=%d m=%d n=%d, want k=%d m=%d n=1000", read.k, read.m, read.n, filter.k, filter.m)
+	}
+
+	path := filepath.Join(t.TempDir(), "passwords.bloom")
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened.bits, filter.bits) {
+		t.Error("opened filter differs from the one written")
+	}
+}
+
+func TestNoFalseNegatives(t *testing.T) {
+	filter := testFilter(10000, 0.001)
+	for i := range 10000 {
+		if password := fmt.Sprintf("password%d", i); !filter.Contains(password) {
+			t.Fatalf("%s was added but isn't contained", password)
+		}
+	}
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	for _, target := range []float64{0.1, 0.01, 0.001} {
+		t.Run(fmt.Sprint(target), func(t *testing.T) {
+			filter := testFilter(20000, target)
+			const trials = 200000
+			positives := 0
+			for i := range trials {
+				if filter.Contains(fmt.Sprintf("absent%d", i)) {
+					positives++
+				}
+			}
+			rate := float64(positives) / trials
+			if rate > target*1.5 || rate < target/2 {
+				t.Errorf("false positive rate %g, want about %g", rate, target)
+			}
+			if estimate := filter.FalsePositiveRate(); estimate > target*1.5 {
+				t.Errorf("estimated rate %g, want about %g", estimate, target)
+			}
+		})
+	}
+}
+
+func header(k uint8, m, n uint64) []byte {
+	header := make([]byte, headerSize)
+	copy(header, Magic)
+	header[4] = Version
+	header[5] = k
+	binary.BigEndian.PutUint64(header[8:], m)
+	binary.BigEndian.PutUint64(header[16:], n)
+	return header
+}
+
+func TestReadRejectsBadFiles(t *testing.T) {
+	var valid bytes.Buffer
+	testFilter(10, 0.01).WriteTo(&valid)
+	wrongVersion := bytes.Clone(valid.Bytes())
+	wrongVersion[4] = Version + 1
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, io.EOF},
+		{"truncated header", valid.Bytes()[:headerSize-1], io.ErrUnexpectedEOF},
+		{"truncated bits", valid.Bytes()[:valid.Len()-1], io.ErrUnexpectedEOF},
+		{"wrong magic", append([]byte("NOPE"), valid.Bytes()[4:]...), ErrFormat},
+		{"no hash functions", header(0, 8, 0), ErrFormat},
+		{"no bits", header(1, 0, 0), ErrFormat},
+		{"oversized", header(1, MaxBits+1, 0), ErrFormat},
+		{"huge", header(1, 1<<63, 0), ErrFormat},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Read(bytes.NewReader(test.data)); !errors.Is(err, test.want) {
+				t.Errorf("Read = %v, want %v", err, test.want)
+			}
+		})
+	}
+	if _, err := Read(bytes.NewReader(wrongVersion)); err == nil {
+		t.Error("read an unsupported format version")
+	}
+}
+
+func TestOpenChecksSize(t *testing.T) {
+	var valid bytes.Buffer
+	testFilter(10, 0.01).WriteTo(&valid)
+	dir := t.TempDir()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", valid.Bytes()[:valid.Len()-1]},
+		{"trailing data", append(bytes.Clone(valid.Bytes()), 0)},
+		{"oversized", header(1, MaxBits+8, 0)},
+		// a header claiming MaxBits mustn't make Open allocate 512 MiB
+		{"larger than the file", header(1, MaxBits, 0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.name)
+			if err := os.WriteFile(path, test.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Open(path); !errors.Is(err, ErrFormat) {
+				t.Errorf("Open = %v, want ErrFormat", err)
+			}
+		})
+	}
+}
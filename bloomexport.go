@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/audibleblink/passdb/bloom"
+)
+
+const (
+	defaultBloomFPRate = 0.001
+
+	// minBloomFPRate and maxBloomFPRate bound the fp of /bloom requests
+	minBloomFPRate = 1e-6
+	maxBloomFPRate = 0.1
+)
+
+// runExportBloom writes a Bloom filter of the plaintext passwords in the
+// record table to a file
+func runExportBloom(args []string) error {
+	flags := flag.NewFlagSet("export-bloom", flag.ExitOnError)
+	output := flags.String("o", "passwords.bloom", "output file")
+	fpRate := flags.Float64("fp", defaultBloomFPRate, "target false positive rate")
+	domain := flags.String("domain", "", "only include passwords for this domain")
+	flags.Parse(args)
+
+	if err := connectBigQuery(); err != nil {
+		return err
+	}
+
+	filter, err := buildBloomFilter(context.Background(), *domain, *fpRate)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if _, err := filter.WriteTo(writer); err != nil {
+		file.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	log.Printf(
+		"Wrote %d passwords to %s (estimated false positive rate %g)",
+		filter.Count(), *output, filter.FalsePositiveRate(),
+	)
+	return file.Close()
+}
+
+// handleBloom serves a filter from bloomFilters, building it if it isn't
+// cached. fp is rounded to a power of ten between minBloomFPRate and
+// maxBloomFPRate, so there are only a few filters per domain.
+func handleBloom(w http.ResponseWriter, r *http.Request) {
+	fpRate := defaultBloomFPRate
+	if value := r.URL.Query().Get("fp"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed <= 0 || parsed >= 1 {
+			JSONError(w, fmt.Errorf("fp must be between 0 and 1"), http.StatusBadRequest)
+			return
+		}
+		fpRate = math.Pow(10, math.Round(math.Log10(parsed)))
+		fpRate = math.Min(math.Max(fpRate, minBloomFPRate), maxBloomFPRate)
+	}
+	domain := r.URL.Query().Get("domain")
+
+	filter, err := bloomFilters.get(r.Context(), domain, fpRate)
+	if err != nil {
+		JSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	filename := "passwords.bloom"
+	if domain != "" {
+		filename = domain + ".bloom"
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	http.ServeContent(w, r, filename, filter.built, bytes.NewReader(filter.data))
+}
+
+// builtBloom is an encoded filter and when it was built
+type builtBloom struct {
+	data  []byte
+	built time.Time
+}
+
+// bloomCache keeps recently built filters, since each build scans the
+// record table twice, up to maxSize bytes of them. Builds run one at a time.
+type bloomCache struct {
+	mu      sync.Mutex
+	filters map[string]*builtBloom
+	size    int64
+	maxSize int64
+	ttl     time.Duration
+
+	// building holds a token while a filter is built
+	building chan struct{}
+}
+
+var bloomFilters = &bloomCache{
+	filters:  make(map[string]*builtBloom),
+	maxSize:  getEnvSize("BLOOM_CACHE_MAX_SIZE", 512<<20),
+	ttl:      getEnvDuration("BLOOM_CACHE_TTL", 24*time.Hour),
+	building: make(chan struct{}, 1),
+}
+
+func (c *bloomCache) get(ctx context.Context, domain string, fpRate float64) (*builtBloom, error) {
+	key := fmt.Sprintf("%s|%g", domain, fpRate)
+	if filter := c.lookup(key); filter != nil {
+		return filter, nil
+	}
+
+	select {
+	case c.building <- struct{}{}:
+		defer func() { <-c.building }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// another request may have built it while this one waited
+	if filter := c.lookup(key); filter != nil {
+		return filter, nil
+	}
+
+	// finish the build for the requests waiting on it even if this
+	// request's client goes away
+	filter, err := buildBloomFilter(context.WithoutCancel(ctx), domain, fpRate)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := filter.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	built := &builtBloom{data: buf.Bytes(), built: time.Now()}
+
+	c.store(key, built)
+	return built, nil
+}
+
+// store caches filter under key, evicting expired and then the oldest
+// filters to make room. A filter larger than maxSize is served uncached.
+func (c *bloomCache) store(key string, filter *builtBloom) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+	for key, cached := range c.filters {
+		if time.Since(cached.built) >= c.ttl {
+			c.remove(key)
+		}
+	}
+
+	size := int64(len(filter.data))
+	if size > c.maxSize {
+		return
+	}
+	for c.size+size > c.maxSize {
+		c.evictOldest()
+	}
+	c.filters[key] = filter
+	c.size += size
+}
+
+func (c *bloomCache) lookup(key string) *builtBloom {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	filter, ok := c.filters[key]
+	if !ok || time.Since(filter.built) >= c.ttl {
+		return nil
+	}
+	return filter
+}
+
+func (c *bloomCache) evictOldest() {
+	oldest := ""
+	for key, filter := range c.filters {
+		if oldest == "" || filter.built.Before(c.filters[oldest].built) {
+			oldest = key
+		}
+	}
+	c.remove(oldest)
+}
+
+func (c *bloomCache) remove(key string) {
+	if filter, ok := c.filters[key]; ok {
+		c.size -= int64(len(filter.data))
+		delete(c.filters, key)
+	}
+}
+
+// buildBloomFilter adds every plaintext password in the record table, or
+// only those for domain when it is set, to a filter sized for fpRate
+func buildBloomFilter(ctx context.Context, domain string, fpRate float64) (*bloom.Filter, error) {
+	var total struct {
+		Passwords int64 `bigquery:"passwords"`
+	}
+	query := passwordsQuery(`COUNT(DISTINCT password) AS passwords`, domain, ``)
+	if err := readRows(ctx, query, &total, func() {}); err != nil {
+		return nil, err
+	}
+
+	// the count includes hashed values, so the filter ends up slightly
+	// oversized rather than exceeding its false positive rate
+	filter := bloom.New(uint64(total.Passwords), fpRate)
+	err := distinctPasswords(ctx, domain, func(password string, count int64) error {
+		if classifyPassword(password) == hashTypePlaintext {
+			filter.Add(password)
+		}
+		return nil
+	})
+	return filter, err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestBloomCacheIsBoundedBySize(t *testing.T) {
+	cache := &bloomCache{filters: make(map[string]*builtBloom), maxSize: 100, ttl: time.Hour}
+	filter := func(size int, age time.Duration) *builtBloom {
+		return &builtBloom{data: bytes.Repeat([]byte{1}, size), built: time.Now().Add(-age)}
+	}
+
+	cache.store("a", filter(40, 3*time.Minute))
+	cache.store("b", filter(40, 2*time.Minute))
+	cache.store("c", filter(40, time.Minute))
+	if cache.lookup("a") != nil || cache.lookup("b") == nil || cache.lookup("c") == nil || cache.size != 80 {
+		t.Errorf("cached %v (%d bytes), want the oldest evicted", cache.filters, cache.size)
+	}
+
+	// replacing a filter doesn't count it twice
+	cache.store("c", filter(70, 0))
+	if cache.lookup("b") != nil || cache.size != 70 {
+		t.Errorf("cached %v (%d bytes), want only the new c", cache.filters, cache.size)
+	}
+
+	cache.store("huge", filter(101, 0))
+	if cache.lookup("huge") != nil || cache.lookup("c") == nil || cache.size != 70 {
+		t.Errorf("cached %v (%d bytes), want a filter over the limit left uncached", cache.filters, cache.size)
+	}
+
+	cache.store("expired", filter(10, 2*time.Hour))
+	cache.store("d", filter(10, 0))
+	if _, ok := cache.filters["expired"]; ok || cache.size != 80 {
+		t.Errorf("cached %v (%d bytes), want expired filters dropped", cache.filters, cache.size)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/audibleblink/passdb/hibp"
+)
+
+// breachFilter narrows the breaches returned for an email, from the query
+// parameters domain, verified, exclude_spam, exclude_fabricated, since and
+// until
+type breachFilter struct {
+	domain            string
+	verifiedOnly      bool
+	excludeSpam       bool
+	excludeFabricated bool
+
+	// since and until are inclusive YYYY-MM-DD bounds on the breach date
+	since, until string
+}
+
+func parseBreachFilter(r *http.Request) (filter breachFilter, err error) {
+	query := r.URL.Query()
+	filter.domain = strings.ToLower(query.Get("domain"))
+
+	flags := map[string]*bool{
+		"verified":           &filter.verifiedOnly,
+		"exclude_spam":       &filter.excludeSpam,
+		"exclude_fabricated": &filter.excludeFabricated,
+	}
+	for name, flag := range flags {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		if *flag, err = strconv.ParseBool(value); err != nil {
+			return filter, fmt.Errorf("invalid value for %s: %q", name, value)
+		}
+	}
+
+	dates := map[string]*string{"since": &filter.since, "until": &filter.until}
+	for name, date := range dates {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse(time.DateOnly, value); err != nil {
+			return filter, fmt.Errorf("%s must be a date in YYYY-MM-DD format", name)
+		}
+		*date = value
+	}
+	return filter, nil
+}
+
+func (f breachFilter) matches(breach hibp.BreachModel) bool {
+	switch {
+	case f.domain != "" && strings.ToLower(breach.Domain) != f.domain:
+		return false
+	case f.verifiedOnly && !breach.IsVerified:
+		return false
+	case f.excludeSpam && breach.IsSpamList:
+		return false
+	case f.excludeFabricated && breach.IsFabricated:
+		return false
+	// ISO dates compare correctly as strings
+	case f.since != "" && breach.BreachDate < f.since:
+		return false
+	case f.until != "" && breach.BreachDate > f.until:
+		return false
+	}
+	return true
+}
+
+// unionDataClasses returns every data class exposed by at least one breach,
+// sorted
+func unionDataClasses(breaches []*breach) []string {
+	seen := make(map[string]bool)
+	dataClasses := make([]string, 0)
+	for _, breach := range breaches {
+		for _, dataClass := range breach.DataClasses {
+			if !seen[dataClass] {
+				seen[dataClass] = true
+				dataClasses = append(dataClasses, dataClass)
+			}
+		}
+	}
+	sort.Strings(dataClasses)
+	return dataClasses
+}
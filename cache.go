@@ -1,24 +1,82 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
-
-	"go.etcd.io/bbolt"
 )
 
 type CacheConfig struct {
 	Enabled    bool
 	DefaultTTL time.Duration
 	RouteTTLs  map[string]time.Duration
-	DBPath     string
+
+	// Backend is where entries are kept: "bolt" for the database at DBPath,
+	// "memory", or "redis" for a server shared between replicas. Redis keys
+	// start with RedisPrefix.
+	Backend       string
+	DBPath        string
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	RedisPrefix   string
+	RedisTimeout  time.Duration
+
+	// KeyVersion prefixes every cache key; changing it invalidates all
+	// existing entries, which are purged at startup
+	KeyVersion string
+
+	// VaryHeaders are request headers whose values are part of the cache
+	// key, for responses that depend on them
+	VaryHeaders []string
+
+	// SweepInterval is how often expired entries are deleted, SweepBatch
+	// entries at a time, and CompactInterval how often the database file is
+	// rewritten to release their space. Zero disables either.
+	SweepInterval   time.Duration
+	SweepBatch      int
+	CompactInterval time.Duration
+
+	// MaxSize bounds the total size of cached entries, which are evicted by
+	// EvictionPolicy ("lru" or "lfu") when it's exceeded. Responses larger
+	// than MaxEntrySize aren't cached. Zero means no limit, except for the
+	// memory backend, which requires one.
+	MaxSize        int64
+	MaxEntrySize   int64
+	EvictionPolicy string
+
+	// EncryptionKey, or the contents of EncryptionKeyFile, is a 32 byte
+	// master key in hex or base64 that turns on encryption of entries.
+	// Entries written under one of PreviousEncryptionKeys are re-encrypted
+	// at startup; entries under any other key are dropped.
+	EncryptionKey          string
+	EncryptionKeyFile      string
+	PreviousEncryptionKeys []string
+
+	// Coalesce makes concurrent misses for the same key wait on a single
+	// backend call. That call runs for at most CoalesceTimeout, even after
+	// the client that started it has gone.
+	Coalesce        bool
+	CoalesceTimeout time.Duration
+
+	// An expired entry younger than its route's stale TTL (from
+	// RouteStaleTTLs, or DefaultStaleTTL) is served while it's refreshed in
+	// the background, by at most MaxRefreshes refreshes at once that each
+	// run for at most RefreshTimeout. One younger than StaleIfError is served
+	// if the backend fails with a 5xx or is rate-limited.
+	DefaultStaleTTL time.Duration
+	RouteStaleTTLs  map[string]time.Duration
+	StaleIfError    time.Duration
+	MaxRefreshes    int
+	RefreshTimeout  time.Duration
 }
 
 type CacheEntry struct {
@@ -27,36 +85,13 @@ type CacheEntry struct {
 	Body       []byte            `json:"body"`
 	Timestamp  time.Time         `json:"timestamp"`
 	TTL        time.Duration     `json:"ttl"`
-}
-
-type responseCapture struct {
-	http.ResponseWriter
-	statusCode int
-	body       *bytes.Buffer
-	headers    http.Header
-}
-
-func newResponseCapture(w http.ResponseWriter) *responseCapture {
-	return &responseCapture{
-		ResponseWriter: w,
-		statusCode:     http.StatusOK,
-		body:           new(bytes.Buffer),
-		headers:        make(http.Header),
-	}
-}
-
-func (rc *responseCapture) WriteHeader(statusCode int) {
-	rc.statusCode = statusCode
-	rc.ResponseWriter.WriteHeader(statusCode)
-}
+	Stale      time.Duration     `json:"stale,omitempty"`
+	Route      string            `json:"route,omitempty"`
 
-func (rc *responseCapture) Write(data []byte) (int, error) {
-	rc.body.Write(data)
-	return rc.ResponseWriter.Write(data)
-}
-
-func (rc *responseCapture) Header() http.Header {
-	return rc.ResponseWriter.Header()
+	// Sealed holds the encrypted headers, body and request key, and KeyID
+	// the key they were encrypted under, when the cache is encrypted
+	Sealed []byte `json:"sealed,omitempty"`
+	KeyID  string `json:"key_id,omitempty"`
 }
 
 func LoadCacheConfig() CacheConfig {
@@ -64,7 +99,53 @@ func LoadCacheConfig() CacheConfig {
 		Enabled:    getEnvBool("CACHE_ENABLED", true),
 		DefaultTTL: getEnvDuration("CACHE_DEFAULT_TTL", 720*time.Hour), // 30 days
 		DBPath:     getEnv("CACHE_DB_PATH", "./cache.db"),
+		Backend:    strings.ToLower(getEnv("CACHE_BACKEND", backendBolt)),
 		RouteTTLs:  make(map[string]time.Duration),
+		KeyVersion: getEnv("CACHE_KEY_VERSION", "1"),
+
+		SweepInterval:   getEnvDuration("CACHE_SWEEP_INTERVAL", 10*time.Minute),
+		SweepBatch:      getEnvInt("CACHE_SWEEP_BATCH", 1000),
+		CompactInterval: getEnvDuration("CACHE_COMPACT_INTERVAL", 24*time.Hour),
+
+		MaxSize:        getEnvSize("CACHE_MAX_SIZE", 0),
+		MaxEntrySize:   getEnvSize("CACHE_MAX_ENTRY_SIZE", 0),
+		EvictionPolicy: strings.ToLower(getEnv("CACHE_EVICTION_POLICY", evictLRU)),
+
+		EncryptionKey:     os.Getenv("CACHE_ENCRYPTION_KEY"),
+		EncryptionKeyFile: os.Getenv("CACHE_ENCRYPTION_KEY_FILE"),
+
+		Coalesce:        getEnvBool("CACHE_COALESCE", true),
+		CoalesceTimeout: getEnvDuration("CACHE_COALESCE_TIMEOUT", 2*time.Minute),
+
+		DefaultStaleTTL: getEnvDuration("CACHE_STALE_TTL", time.Hour),
+		RouteStaleTTLs:  make(map[string]time.Duration),
+		StaleIfError:    getEnvDuration("CACHE_STALE_IF_ERROR", 24*time.Hour),
+		MaxRefreshes:    getEnvInt("CACHE_MAX_REFRESHES", 4),
+		RefreshTimeout:  getEnvDuration("CACHE_REFRESH_TIMEOUT", 2*time.Minute),
+
+		RedisAddr:     getEnv("CACHE_REDIS_ADDR", "localhost:6379"),
+		RedisPassword: os.Getenv("CACHE_REDIS_PASSWORD"),
+		RedisDB:       getEnvInt("CACHE_REDIS_DB", 0),
+		RedisPrefix:   getEnv("CACHE_REDIS_PREFIX", "passdb:cache:"),
+		RedisTimeout:  getEnvDuration("CACHE_REDIS_TIMEOUT", 5*time.Second),
+	}
+	for _, key := range strings.Split(os.Getenv("CACHE_ENCRYPTION_PREVIOUS_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			config.PreviousEncryptionKeys = append(config.PreviousEncryptionKeys, key)
+		}
+	}
+	if config.Backend == backendMemory && config.MaxSize <= 0 {
+		config.MaxSize = defaultMemoryCacheSize
+	}
+	if config.EvictionPolicy != evictLRU && config.EvictionPolicy != evictLFU {
+		log.Printf("Unknown CACHE_EVICTION_POLICY %q, using %s", config.EvictionPolicy, evictLRU)
+		config.EvictionPolicy = evictLRU
+	}
+
+	for _, header := range strings.Split(getEnv("CACHE_VARY_HEADERS", "Accept"), ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			config.VaryHeaders = append(config.VaryHeaders, http.CanonicalHeaderKey(header))
+		}
 	}
 
 	config.RouteTTLs["/api/v1/breaches/"] = getEnvDuration(
@@ -87,6 +168,22 @@ func LoadCacheConfig() CacheConfig {
 		"CACHE_TTL_EMAILS",
 		720*time.Hour,
 	) // 30 days
+	config.RouteTTLs[domainBreachesRoute] = getEnvDuration(
+		"CACHE_TTL_DOMAIN_BREACHES",
+		24*time.Hour,
+	) // 1 day
+
+	for route, name := range map[string]string{
+		"/api/v1/breaches/":  "BREACHES",
+		"/api/v1/usernames/": "USERNAMES",
+		"/api/v1/passwords/": "PASSWORDS",
+		"/api/v1/domains/":   "DOMAINS",
+		"/api/v1/emails/":    "EMAILS",
+	} {
+		if stale := getEnvDuration("CACHE_STALE_TTL_"+name, -1); stale >= 0 {
+			config.RouteStaleTTLs[route] = stale
+		}
+	}
 
 	return config
 }
@@ -107,6 +204,15 @@ func getEnvBool(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
 func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
 		if parsed, err := time.ParseDuration(value); err == nil {
@@ -126,132 +232,358 @@ func CacheMiddleware(config CacheConfig) func(http.Handler) http.Handler {
 		}
 	}
 
-	db, err := bbolt.Open(config.DBPath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	current, previous, err := loadCacheCiphers(config)
 	if err != nil {
-		log.Printf("Failed to open cache database: %v", err)
+		log.Printf("Failed to load cache encryption key, caching disabled: %v", err)
 		return func(next http.Handler) http.Handler {
 			return next
 		}
 	}
 
-	// Store db reference in global variable for management functions
-	cacheDB = db
+	backend, err := openCacheStore(config)
+	if err != nil {
+		log.Printf("Failed to open %s cache: %v", config.Backend, err)
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
 
-	err = db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("cache"))
-		return err
-	})
+	rewritten, err := checkCacheKey(backend, config, current, previous)
 	if err != nil {
-		log.Printf("Failed to create cache bucket: %v", err)
-		db.Close()
-		cacheDB = nil
+		log.Printf("Failed to check cache encryption key, caching disabled: %v", err)
+		backend.Close()
 		return func(next http.Handler) http.Handler {
 			return next
 		}
 	}
+	if bolt, ok := backend.(*boltCache); ok && rewritten {
+		// freed pages still hold the entries as they were written under
+		// the old key, or in plaintext, until the file is rewritten
+		if _, err := bolt.compact(); err != nil {
+			log.Printf("Failed to compact cache: %v", err)
+		}
+	}
+
+	if purged, err := purgeOldKeyVersions(backend, config); err != nil {
+		log.Printf("Failed to purge old cache entries: %v", err)
+	} else if purged > 0 {
+		log.Printf("Purged %d cache entries from previous key versions", purged)
+	}
+
+	// Store a reference in a global variable for management functions
+	store := &entryStore{store: backend, cipher: current}
+	cacheDB = store
+
+	refreshSlots = make(chan struct{}, max(config.MaxRefreshes, 1))
+
+	if sweeper, ok := backend.(sweeper); ok {
+		go sweepPeriodically(sweeper, config)
+	}
+	if bolt, ok := backend.(*boltCache); ok {
+		go bolt.compactPeriodically(config)
+	}
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Check if this route should be cached
-			if !shouldCache(r.URL.Path, config) {
+			if !shouldCache(r, config) || store.healthy() != nil {
 				next.ServeHTTP(w, r)
 				return
 			}
 
-			cacheKey := fmt.Sprintf("%s:%s", r.Method, r.URL.Path)
+			cacheKey := buildCacheKey(r, config)
 
-			var cached *CacheEntry
-			err := db.View(func(tx *bbolt.Tx) error {
-				bucket := tx.Bucket([]byte("cache"))
-				data := bucket.Get([]byte(cacheKey))
-				if data == nil {
-					return nil
+			// serve calls the backend and caches a successful response
+			serve := func(r *http.Request) *bufferedResponse {
+				resp := newBufferedResponse()
+				next.ServeHTTP(resp, r)
+				if resp.statusCode < 200 || resp.statusCode >= 300 {
+					log.Printf("CACHE MISS: %s (not cached - status %d)", cacheKey, resp.statusCode)
+					return resp
 				}
-
-				cached = &CacheEntry{}
-				return json.Unmarshal(data, cached)
-			})
-
-			if err == nil && cached != nil {
-				if time.Since(cached.Timestamp) < cached.TTL {
-					for key, value := range cached.Headers {
-						w.Header().Set(key, value)
-					}
-					w.Header().Set("X-Cache", "HIT")
-					w.WriteHeader(cached.StatusCode)
-					w.Write(cached.Body)
-					log.Printf("CACHE HIT: %s", cacheKey)
-					return
+				if noStore(resp.Header()) {
+					log.Printf("CACHE MISS: %s (not cached - no-store)", cacheKey)
+					return resp
 				}
-			}
-
-			rc := newResponseCapture(w)
-			next.ServeHTTP(rc, r)
 
-			if rc.statusCode >= 200 && rc.statusCode < 300 {
 				ttl := getTTLForPath(r.URL.Path, config)
+				route, _ := matchRoute(r.URL.Path, config)
+				staleTTL := max(getStaleTTLForPath(r.URL.Path, config), config.StaleIfError)
 
 				entry := CacheEntry{
-					StatusCode: rc.statusCode,
+					StatusCode: resp.statusCode,
 					Headers:    make(map[string]string),
-					Body:       rc.body.Bytes(),
+					Body:       resp.body.Bytes(),
 					Timestamp:  time.Now(),
 					TTL:        ttl,
+					Stale:      staleTTL,
+					Route:      route,
 				}
 
-				for key, values := range rc.Header() {
+				for key, values := range resp.Header() {
 					if len(values) > 0 {
 						entry.Headers[key] = values[0]
 					}
 				}
 
-				data, err := json.Marshal(entry)
-				if err == nil {
-					db.Update(func(tx *bbolt.Tx) error {
-						bucket := tx.Bucket([]byte("cache"))
-						return bucket.Put([]byte(cacheKey), data)
-					})
+				stored, err := store.put(cacheKey, entry, config)
+				switch {
+				case err != nil:
+					log.Printf("CACHE MISS: %s (not cached - %v)", cacheKey, err)
+				case !stored:
+					log.Printf("CACHE MISS: %s (not cached - larger than %d bytes)", cacheKey, config.MaxEntrySize)
+				default:
+					log.Printf("CACHE MISS: %s (cached for %v)", cacheKey, ttl)
+				}
+				return resp
+			}
+
+			cached, err := store.get(cacheKey, config)
+			if err != nil {
+				log.Printf("Failed to read cache entry: %v", err)
+			}
+
+			// stale is an expired entry to fall back on if the backend
+			// fails, as long as it's within the stale-if-error window
+			var stale *CacheEntry
+			if err == nil && cached != nil {
+				age := time.Since(cached.Timestamp)
+				switch {
+				case age < cached.TTL:
+					writeCachedEntry(w, cached, "HIT")
+					log.Printf("CACHE HIT: %s", cacheKey)
+					go store.recordHit(cacheKey, config)
+					return
+				case age < cached.TTL+getStaleTTLForPath(r.URL.Path, config):
+					writeCachedEntry(w, cached, "STALE")
+					log.Printf("CACHE STALE: %s (refreshing)", cacheKey)
+					countStale(func(stats *StaleStats) { stats.Served++ })
+					go store.recordHit(cacheKey, config)
+					refresh(r, cacheKey, serve, config)
+					return
+				case age < cached.TTL+config.StaleIfError:
+					stale = cached
+				}
+			}
+
+			resp, xCache := newBufferedResponse(), "MISS"
+			if config.Coalesce {
+				// the backend call is shared with any requests that coalesce
+				// onto this one, so it outlives this request's client
+				var leader bool
+				resp, leader, err = misses.do(r.Context(), cacheKey, func() *bufferedResponse {
+					ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), config.CoalesceTimeout)
+					defer cancel()
+					resp := serve(r.WithContext(ctx))
+					if r.Context().Err() != nil {
+						countCoalesce(func(stats *CoalesceStats) { stats.DetachedLeaders++ })
+					}
+					return resp
+				})
+				switch {
+				case errors.Is(err, errLeaderPanicked):
+					log.Printf("CACHE MISS: %s (coalesced request failed, retrying)", cacheKey)
+					resp = serve(r)
+				case err != nil:
+					log.Printf("CACHE MISS: %s (client went away while coalesced)", cacheKey)
+					return
+				case !leader:
+					log.Printf("CACHE COALESCED: %s", cacheKey)
+					xCache = "COALESCED"
 				}
-				log.Printf("CACHE MISS: %s (cached for %v)", cacheKey, ttl)
 			} else {
-				log.Printf("CACHE MISS: %s (not cached - status %d)", cacheKey, rc.statusCode)
+				resp = serve(r)
 			}
 
-			w.Header().Set("X-Cache", "MISS")
+			if stale != nil && serveStaleOn(resp.statusCode) {
+				writeCachedEntry(w, stale, "STALE")
+				log.Printf("CACHE STALE: %s (backend returned %d)", cacheKey, resp.statusCode)
+				countStale(func(stats *StaleStats) { stats.ServedOnError++ })
+				return
+			}
+			resp.writeTo(w, xCache)
 		})
 	}
 }
 
 func getTTLForPath(path string, config CacheConfig) time.Duration {
-	for routePattern, ttl := range config.RouteTTLs {
-		if strings.HasPrefix(path, routePattern) {
-			return ttl
-		}
+	if routePattern, ok := matchRoute(path, config); ok {
+		return config.RouteTTLs[routePattern]
 	}
 	return config.DefaultTTL
 }
 
-func shouldCache(path string, config CacheConfig) bool {
-	// Check if the path matches any configured cache routes
+// matchRoute returns the most specific route pattern that path falls under.
+// Patterns are path prefixes in which a "*" segment matches any one segment,
+// e.g. "/api/v1/domains/*/breaches".
+func matchRoute(path string, config CacheConfig) (string, bool) {
+	best := ""
 	for routePattern := range config.RouteTTLs {
-		if strings.HasPrefix(path, routePattern) {
+		if !routeMatches(path, routePattern) {
+			continue
+		}
+		if len(routePattern) > len(best) || (len(routePattern) == len(best) && routePattern < best) {
+			best = routePattern
+		}
+	}
+	return best, best != ""
+}
+
+func routeMatches(path, routePattern string) bool {
+	if !strings.Contains(routePattern, "*") {
+		return strings.HasPrefix(path, routePattern)
+	}
+
+	pathSegments := strings.Split(path, "/")
+	patternSegments := strings.Split(routePattern, "/")
+	if len(pathSegments) < len(patternSegments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		switch {
+		case segment == "*":
+			if pathSegments[i] == "" {
+				return false
+			}
+		case segment == "" && i == len(patternSegments)-1:
+			// a trailing slash matches anything below it
+		case segment != pathSegments[i]:
+			return false
+		}
+	}
+	return true
+}
+
+// noStore reports whether a handler marked its response as not cacheable,
+// such as a partial result while a breach provider is failing
+func noStore(headers http.Header) bool {
+	for _, directive := range strings.Split(headers.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-store") {
 			return true
 		}
 	}
 	return false
 }
 
-// Global cache database reference for management functions
-var cacheDB *bbolt.DB
+func shouldCache(r *http.Request, config CacheConfig) bool {
+	// Only GETs are idempotent; the cache key doesn't cover request bodies
+	if r.Method != http.MethodGet {
+		return false
+	}
+
+	// Check if the path matches any configured cache routes
+	route, ok := matchRoute(r.URL.Path, config)
+	return ok && route != domainBreachesRoute
+}
+
+// buildCacheKey identifies a response by everything that can change it: the
+// key version, method, path, canonical query string and vary headers, e.g.
+// "v1:GET:/api/v1/breaches/a@b.c?description=text&verified=true|Accept=*/*"
+func buildCacheKey(r *http.Request, config CacheConfig) string {
+	var key strings.Builder
+	key.WriteString(cacheKeyPrefix(config))
+	key.WriteString(r.Method + ":" + r.URL.Path)
+	if query := canonicalQuery(r.URL.RawQuery); query != "" {
+		key.WriteString("?" + query)
+	}
+	for _, header := range config.VaryHeaders {
+		if values := r.Header.Values(header); len(values) > 0 {
+			key.WriteString("|" + header + "=" + strings.Join(values, ","))
+		}
+	}
+	return key.String()
+}
+
+func cacheKeyPrefix(config CacheConfig) string {
+	return "v" + config.KeyVersion + ":"
+}
+
+// canonicalQuery sorts query parameters by name and normalizes their
+// encoding, so equivalent query strings share a cache entry. The order of
+// repeated parameters is kept, as it can be significant.
+func canonicalQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	return values.Encode()
+}
+
+// cacheKeyPath extracts the request path from a cache key
+func cacheKeyPath(key string) string {
+	_, rest, _ := strings.Cut(key, ":")
+	_, path, _ := strings.Cut(rest, ":")
+	path, _, _ = strings.Cut(path, "|")
+	path, _, _ = strings.Cut(path, "?")
+	return path
+}
+
+// cachedUpstream returns the upstream response cached under key, calling
+// fetch and caching its result for ttl on a miss. It's for upstream data a
+// handler combines with live results, which can't be cached as part of the
+// whole response. Without a cache, fetch is always called.
+func cachedUpstream[T any](key string, ttl time.Duration, fetch func() (T, error)) (T, error) {
+	cacheKey := cacheKeyPrefix(cacheConfig) + "UPSTREAM:" + key
+	if cacheDB != nil {
+		cached, err := cacheDB.get(cacheKey, cacheConfig)
+		if err != nil {
+			log.Printf("Failed to read cache entry: %v", err)
+		}
+		if cached != nil && time.Since(cached.Timestamp) < cached.TTL {
+			var value T
+			if err := json.Unmarshal(cached.Body, &value); err == nil {
+				log.Printf("CACHE HIT: %s", cacheKey)
+				go cacheDB.recordHit(cacheKey, cacheConfig)
+				return value, nil
+			}
+		}
+	}
+
+	value, err := fetch()
+	if err != nil || cacheDB == nil {
+		return value, err
+	}
+
+	body, err := json.Marshal(value)
+	if err != nil {
+		return value, nil
+	}
+	entry := CacheEntry{
+		StatusCode: http.StatusOK,
+		Body:       body,
+		Timestamp:  time.Now(),
+		TTL:        ttl,
+		Route:      "upstream",
+	}
+	if _, err := cacheDB.put(cacheKey, entry, cacheConfig); err != nil {
+		log.Printf("Failed to cache %s: %v", cacheKey, err)
+	}
+	return value, nil
+}
+
+// Global cache store reference for management functions
+var cacheDB *entryStore
 var cacheConfig CacheConfig
 
 // CacheStats represents cache statistics
 type CacheStats struct {
-	Enabled       bool                     `json:"enabled"`
-	TotalEntries  int                      `json:"total_entries"`
-	DatabaseSize  int64                    `json:"database_size_bytes"`
-	Configuration map[string]interface{}   `json:"configuration"`
-	EntriesByPath map[string]int           `json:"entries_by_path"`
+	Enabled        bool                   `json:"enabled"`
+	TotalEntries   int                    `json:"total_entries"`
+	LiveEntries    int                    `json:"live_entries"`
+	StaleEntries   int                    `json:"stale_entries"`
+	ExpiredEntries int                    `json:"expired_entries"`
+	Backend        StoreStats             `json:"backend"`
+	DatabaseSize   int64                  `json:"database_size_bytes"`
+	TotalSize      int64                  `json:"total_size_bytes"`
+	Configuration  map[string]interface{} `json:"configuration"`
+	EntriesByPath  map[string]int         `json:"entries_by_path"`
+	Janitor        JanitorStats           `json:"janitor"`
+	Evictions      EvictionStats          `json:"evictions"`
+	Coalescing     CoalesceStats          `json:"coalescing"`
+	Stale          StaleStats             `json:"stale"`
 }
 
 // GetCacheStats returns current cache statistics
@@ -264,7 +596,29 @@ func GetCacheStats() (CacheStats, error) {
 
 	// Add configuration details
 	stats.Configuration["default_ttl"] = cacheConfig.DefaultTTL.String()
-	stats.Configuration["db_path"] = cacheConfig.DBPath
+	stats.Configuration["backend"] = cacheConfig.Backend
+	switch cacheConfig.Backend {
+	case backendBolt:
+		stats.Configuration["db_path"] = cacheConfig.DBPath
+	case backendRedis:
+		stats.Configuration["redis_addr"] = cacheConfig.RedisAddr
+		stats.Configuration["redis_db"] = cacheConfig.RedisDB
+		stats.Configuration["redis_prefix"] = cacheConfig.RedisPrefix
+	}
+	stats.Configuration["key_version"] = cacheConfig.KeyVersion
+	stats.Configuration["vary_headers"] = cacheConfig.VaryHeaders
+	stats.Configuration["sweep_interval"] = cacheConfig.SweepInterval.String()
+	stats.Configuration["sweep_batch"] = cacheConfig.SweepBatch
+	stats.Configuration["compact_interval"] = cacheConfig.CompactInterval.String()
+	stats.Configuration["max_size"] = cacheConfig.MaxSize
+	stats.Configuration["max_entry_size"] = cacheConfig.MaxEntrySize
+	stats.Configuration["eviction_policy"] = cacheConfig.EvictionPolicy
+	stats.Janitor = getJanitorStats()
+	stats.Configuration["coalesce"] = cacheConfig.Coalesce
+	stats.Configuration["coalesce_timeout"] = cacheConfig.CoalesceTimeout.String()
+	stats.Evictions = getEvictionStats()
+	stats.Coalescing = getCoalesceStats()
+	stats.Stale = getStaleStats()
 	
 	// Add route-specific TTLs
 	routeTTLs := make(map[string]string)
@@ -273,41 +627,51 @@ func GetCacheStats() (CacheStats, error) {
 	}
 	stats.Configuration["route_ttls"] = routeTTLs
 
+	staleTTLs := make(map[string]string)
+	for route, stale := range cacheConfig.RouteStaleTTLs {
+		staleTTLs[route] = stale.String()
+	}
+	stats.Configuration["default_stale_ttl"] = cacheConfig.DefaultStaleTTL.String()
+	stats.Configuration["route_stale_ttls"] = staleTTLs
+	stats.Configuration["stale_if_error"] = cacheConfig.StaleIfError.String()
+	stats.Configuration["max_refreshes"] = cacheConfig.MaxRefreshes
+	stats.Configuration["refresh_timeout"] = cacheConfig.RefreshTimeout.String()
+
 	if !cacheConfig.Enabled || cacheDB == nil {
 		return stats, nil
 	}
 
-	// Get database file size
-	if fileInfo, err := os.Stat(cacheConfig.DBPath); err == nil {
-		stats.DatabaseSize = fileInfo.Size()
+	backend, err := cacheDB.store.Stats()
+	if err != nil {
+		return stats, err
 	}
+	stats.Backend = backend
+	stats.DatabaseSize = backend.Size
 
 	// Count entries and group by path prefix
-	err := cacheDB.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte("cache"))
-		if bucket == nil {
-			return nil
+	now := time.Now()
+	err = cacheDB.store.Scan("", func(k string, v []byte) error {
+		stats.TotalEntries++
+		stats.TotalSize += int64(len(k) + len(v))
+
+		var header cacheEntryHeader
+		json.Unmarshal(v, &header)
+		switch {
+		case entryExpired(v, now):
+			stats.ExpiredEntries++
+		case now.Sub(header.Timestamp) >= header.TTL:
+			stats.StaleEntries++
+		default:
+			stats.LiveEntries++
 		}
 
-		return bucket.ForEach(func(k, v []byte) error {
-			stats.TotalEntries++
-			
-			// Extract path from cache key (format: "METHOD:path")
-			key := string(k)
-			parts := strings.SplitN(key, ":", 2)
-			if len(parts) == 2 {
-				path := parts[1]
-				// Group by route prefix
-				for routePrefix := range cacheConfig.RouteTTLs {
-					if strings.HasPrefix(path, routePrefix) {
-						stats.EntriesByPath[routePrefix]++
-						break
-					}
-				}
-			}
-			
-			return nil
-		})
+		// Group by route prefix
+		if header.Route != "" {
+			stats.EntriesByPath[header.Route]++
+		} else if routePrefix, ok := matchRoute(cacheKeyPath(k), cacheConfig); ok {
+			stats.EntriesByPath[routePrefix]++
+		}
+		return nil
 	})
 
 	return stats, err
@@ -315,23 +679,8 @@ func GetCacheStats() (CacheStats, error) {
 
 // ClearCache removes all entries from the cache
 func ClearCache() error {
-	if !cacheConfig.Enabled || cacheDB == nil {
-		return fmt.Errorf("cache is not enabled or not initialized")
-	}
-
-	return cacheDB.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte("cache"))
-		if bucket == nil {
-			return nil
-		}
-
-		// Delete and recreate the bucket to clear all entries
-		if err := tx.DeleteBucket([]byte("cache")); err != nil {
-			return err
-		}
-		_, err := tx.CreateBucket([]byte("cache"))
-		return err
-	})
+	_, err := ClearCachePattern("")
+	return err
 }
 
 // ClearCachePattern removes cache entries matching the given pattern
@@ -340,41 +689,36 @@ func ClearCachePattern(pattern string) (int, error) {
 		return 0, fmt.Errorf("cache is not enabled or not initialized")
 	}
 
-	var deletedCount int
-	
-	err := cacheDB.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte("cache"))
-		if bucket == nil {
-			return nil
-		}
-
-		// Collect keys to delete
-		var keysToDelete [][]byte
-		
-		err := bucket.ForEach(func(k, v []byte) error {
-			key := string(k)
-			// Check if key contains the pattern
-			if strings.Contains(key, pattern) {
-				keysToDelete = append(keysToDelete, k)
+	// Collect keys to delete
+	var keysToDelete []string
+	err := cacheDB.store.Scan("", func(k string, v []byte) error {
+		key := k
+		// Encrypted entries are stored under a hash, so match against
+		// the request key sealed inside them
+		if cacheDB.cipher != nil && pattern != "" {
+			var entry CacheEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return nil
 			}
-			return nil
-		})
-		
-		if err != nil {
-			return err
-		}
-
-		// Delete the collected keys
-		for _, key := range keysToDelete {
-			if err := bucket.Delete(key); err != nil {
-				return err
+			opened, err := cacheDB.cipher.open(&entry, k)
+			if err != nil {
+				return nil
 			}
-			deletedCount++
+			key = opened
+		}
+		// Check if key contains the pattern
+		if strings.Contains(key, pattern) {
+			keysToDelete = append(keysToDelete, k)
 		}
-
 		return nil
 	})
+	if err != nil {
+		return 0, err
+	}
 
-	return deletedCount, err
+	// Delete the collected keys
+	if err := cacheDB.store.Delete(keysToDelete...); err != nil {
+		return 0, err
+	}
+	return len(keysToDelete), nil
 }
-
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testCacheConfig caches everything under /api/ for an hour in memory
+func testCacheConfig() CacheConfig {
+	return CacheConfig{
+		Enabled:         true,
+		Backend:         backendMemory,
+		DefaultTTL:      time.Hour,
+		RouteTTLs:       map[string]time.Duration{"/api/": time.Hour},
+		RouteStaleTTLs:  make(map[string]time.Duration),
+		KeyVersion:      "1",
+		MaxSize:         1 << 20,
+		EvictionPolicy:  evictLRU,
+		CoalesceTimeout: time.Minute,
+		MaxRefreshes:    1,
+		RefreshTimeout:  time.Minute,
+	}
+}
+
+// useCache wraps handler in a cache middleware built from config, restoring
+// the global cache afterwards
+func useCache(t *testing.T, config CacheConfig, handler http.HandlerFunc) http.Handler {
+	t.Helper()
+	previousConfig, previousDB, previousSlots := cacheConfig, cacheDB, refreshSlots
+	cached := CacheMiddleware(config)(handler)
+	if config.Enabled && cacheDB == previousDB {
+		t.Fatal("cache middleware didn't open the cache")
+	}
+	store := cacheDB
+	t.Cleanup(func() {
+		store.store.Close()
+		cacheConfig, cacheDB, refreshSlots = previousConfig, previousDB, previousSlots
+	})
+	return cached
+}
+
+// get requests target from handler and returns the response
+func get(handler http.Handler, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+	return rec
+}
+
+func TestCacheHit(t *testing.T) {
+	calls := 0
+	handler := useCache(t, testCacheConfig(), func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"ok":true}`))
+	})
+
+	for _, want := range []string{"MISS", "HIT"} {
+		rec := get(handler, "/api/v1/breaches/test@example.com")
+		if got := rec.Header().Get("X-Cache"); got != want {
+			t.Errorf("X-Cache = %q, want %s", got, want)
+		}
+		if rec.Body.String() != `{"ok":true}` {
+			t.Errorf("body = %q", rec.Body)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("backend called %d times, want 1", calls)
+	}
+}
+
+func TestNoStoreResponsesAreNotCached(t *testing.T) {
+	calls := 0
+	handler := useCache(t, testCacheConfig(), func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("X-Breach-Provider-Errors", "other")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(`[]`))
+	})
+
+	for range 2 {
+		rec := get(handler, "/api/v1/breaches/test@example.com")
+		if got := rec.Header().Get("X-Cache"); got != "MISS" {
+			t.Errorf("X-Cache = %q, want MISS", got)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("Cache-Control = %q, want no-store", got)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("backend called %d times, want every request to reach it", calls)
+	}
+}
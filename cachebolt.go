@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// boltCache is a CacheStore in a local bbolt database. It guards the database
+// so compaction can swap in a new file while requests are being served.
+// Expired entries are left for the sweeper.
+type boltCache struct {
+	mu     sync.RWMutex
+	db     *bbolt.DB
+	path   string
+	config CacheConfig
+
+	// closedErr is set when the database couldn't be reopened after a
+	// compaction, leaving db closed until a later reopen succeeds
+	closedErr error
+}
+
+// openBoltCache opens the database at config.DBPath, creating its buckets
+func openBoltCache(config CacheConfig) (*boltCache, error) {
+	db, err := bbolt.Open(config.DBPath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(createCacheBuckets); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := reconcileCacheSizes(db); err != nil {
+		log.Printf("Failed to reconcile cache sizes: %v", err)
+	}
+	return &boltCache{db: db, path: config.DBPath, config: config}, nil
+}
+
+func (c *boltCache) Get(key string) ([]byte, error) {
+	var value []byte
+	err := c.View(func(tx *bbolt.Tx) error {
+		if data := tx.Bucket([]byte("cache")).Get([]byte(key)); data != nil {
+			value = append([]byte{}, data...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Set stores an entry, then evicts entries in the background if the cache
+// has grown past its maximum size. Entries carry their own expiry, so ttl
+// is left to the sweeper.
+func (c *boltCache) Set(key string, value []byte, ttl time.Duration) error {
+	var size int64
+	err := c.Update(func(tx *bbolt.Tx) error {
+		if err := putEntry(tx, []byte(key), value); err != nil {
+			return err
+		}
+		size = totalSize(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.config.MaxSize > 0 && size > c.config.MaxSize && evicting.CompareAndSwap(false, true) {
+		go func() {
+			defer evicting.Store(false)
+			if err := c.evict(c.config); err != nil {
+				log.Printf("Failed to evict cache entries: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+func (c *boltCache) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.Update(func(tx *bbolt.Tx) error {
+		for _, key := range keys {
+			if err := deleteEntry(tx, []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *boltCache) Scan(prefix string, fn func(key string, value []byte) error) error {
+	return c.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket([]byte("cache")).Cursor()
+		for k, v := cursor.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = cursor.Next() {
+			if err := fn(string(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *boltCache) KeyID() (id string, ok bool, err error) {
+	err = c.View(func(tx *bbolt.Tx) error {
+		stored := tx.Bucket([]byte(cacheMetaBucket)).Get([]byte(cacheKeyIDKey))
+		id, ok = string(stored), stored != nil
+		return nil
+	})
+	return
+}
+
+func (c *boltCache) SetKeyID(id string) error {
+	return c.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(cacheMetaBucket)).Put([]byte(cacheKeyIDKey), []byte(id))
+	})
+}
+
+func (c *boltCache) Stats() (StoreStats, error) {
+	stats := StoreStats{Backend: backendBolt}
+	err := c.View(func(tx *bbolt.Tx) error {
+		stats.Entries = tx.Bucket([]byte("cache")).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	stats.Size, err = fileSize(c.path)
+	return stats, err
+}
+
+func (c *boltCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closedErr != nil {
+		return nil
+	}
+	return c.db.Close()
+}
+
+func (c *boltCache) healthy() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closedErr
+}
+
+func (c *boltCache) View(fn func(tx *bbolt.Tx) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closedErr != nil {
+		return c.closedErr
+	}
+	return c.db.View(fn)
+}
+
+func (c *boltCache) Update(fn func(tx *bbolt.Tx) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closedErr != nil {
+		return c.closedErr
+	}
+	return c.db.Update(fn)
+}
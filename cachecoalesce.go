@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// errLeaderPanicked is returned to requests coalesced onto one whose handler
+// panicked before producing a response
+var errLeaderPanicked = errors.New("coalesced request panicked")
+
+// CoalesceStats counts cache misses that waited on an identical request
+// already in flight instead of calling the backend themselves
+type CoalesceStats struct {
+	Leaders         int64 `json:"leaders"`
+	Coalesced       int64 `json:"coalesced"`
+	InFlight        int   `json:"in_flight"`
+	LeaderErrors    int64 `json:"leader_errors"`
+	LeaderPanics    int64 `json:"leader_panics"`
+	DetachedLeaders int64 `json:"detached_leaders"`
+	Abandoned       int64 `json:"abandoned"`
+}
+
+var (
+	coalesceMu    sync.Mutex
+	coalesceStats CoalesceStats
+)
+
+func getCoalesceStats() CoalesceStats {
+	coalesceMu.Lock()
+	defer coalesceMu.Unlock()
+	return coalesceStats
+}
+
+func countCoalesce(update func(stats *CoalesceStats)) {
+	coalesceMu.Lock()
+	update(&coalesceStats)
+	coalesceMu.Unlock()
+}
+
+// bufferedResponse holds a whole response so it can be replayed to every
+// request waiting on it
+type bufferedResponse struct {
+	statusCode int
+	headers    http.Header
+	body       bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{statusCode: http.StatusOK, headers: make(http.Header)}
+}
+
+func (br *bufferedResponse) Header() http.Header {
+	return br.headers
+}
+
+func (br *bufferedResponse) WriteHeader(statusCode int) {
+	br.statusCode = statusCode
+}
+
+func (br *bufferedResponse) Write(data []byte) (int, error) {
+	return br.body.Write(data)
+}
+
+// writeTo replays the response to w, tagged with how it was served
+func (br *bufferedResponse) writeTo(w http.ResponseWriter, xCache string) {
+	for key, values := range br.headers {
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	w.Header().Set("X-Cache", xCache)
+	w.WriteHeader(br.statusCode)
+	w.Write(br.body.Bytes())
+}
+
+// flight is a backend call shared by concurrent requests for one cache key
+type flight struct {
+	done chan struct{}
+	resp *bufferedResponse
+}
+
+// flightGroup deduplicates concurrent cache misses, so only the first request
+// for a key calls the backend and the rest wait for its response
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+var misses = &flightGroup{flights: make(map[string]*flight)}
+
+// do runs fetch unless a call for key is already in flight, in which case it
+// waits for that call's response instead. Waiting stops when ctx is done.
+// If the leading call panics, the panic is passed on to the leader and
+// waiters get errLeaderPanicked, leaving them to call the backend themselves.
+func (g *flightGroup) do(ctx context.Context, key string, fetch func() *bufferedResponse) (resp *bufferedResponse, leader bool, err error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			countCoalesce(func(stats *CoalesceStats) { stats.Abandoned++ })
+			return nil, false, ctx.Err()
+		}
+		if f.resp == nil {
+			return nil, false, errLeaderPanicked
+		}
+		countCoalesce(func(stats *CoalesceStats) { stats.Coalesced++ })
+		return f.resp, false, nil
+	}
+
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+	countCoalesce(func(stats *CoalesceStats) {
+		stats.Leaders++
+		stats.InFlight++
+	})
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+
+		recovered := recover()
+		countCoalesce(func(stats *CoalesceStats) {
+			stats.InFlight--
+			if recovered != nil {
+				stats.LeaderPanics++
+			}
+		})
+		if recovered != nil {
+			panic(recovered)
+		}
+	}()
+
+	f.resp = fetch()
+	if f.resp.statusCode < 200 || f.resp.statusCode >= 300 {
+		countCoalesce(func(stats *CoalesceStats) { stats.LeaderErrors++ })
+	}
+	return f.resp, true, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const coalescedTarget = "/api/v1/breaches/test@example.com"
+
+// blockingBackend is a handler whose calls wait until release is closed, so
+// requests can pile up behind one in flight
+type blockingBackend struct {
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+	status  int
+}
+
+func newBlockingBackend(status int) *blockingBackend {
+	return &blockingBackend{started: make(chan struct{}, 16), release: make(chan struct{}), status: status}
+}
+
+func (b *blockingBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.calls.Add(1)
+	b.started <- struct{}{}
+	<-b.release
+	w.WriteHeader(b.status)
+	w.Write([]byte(`{"calls":1}`))
+}
+
+func useCoalescingCache(t *testing.T, backend *blockingBackend) http.Handler {
+	config := testCacheConfig()
+	config.Coalesce = true
+	return useCache(t, config, backend.ServeHTTP)
+}
+
+// getConcurrently sends n requests for target once the first has reached
+// the backend, and returns their responses once the backend is released
+func getConcurrently(handler http.Handler, backend *blockingBackend, n int) []*httptest.ResponseRecorder {
+	recs := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(recs[i], httptest.NewRequest("GET", coalescedTarget, nil))
+		}()
+		if i == 0 {
+			<-backend.started
+		}
+	}
+	// give the followers time to join the flight
+	time.Sleep(100 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+	return recs
+}
+
+func TestConcurrentMissesCallBackendOnce(t *testing.T) {
+	backend := newBlockingBackend(http.StatusOK)
+	handler := useCoalescingCache(t, backend)
+	before := getCoalesceStats()
+
+	recs := getConcurrently(handler, backend, 10)
+
+	if backend.calls.Load() != 1 {
+		t.Errorf("backend called %d times, want 1", backend.calls.Load())
+	}
+	xCache := make(map[string]int)
+	for _, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"calls":1}` {
+			t.Errorf("got %d %q", rec.Code, rec.Body)
+		}
+		xCache[rec.Header().Get("X-Cache")]++
+	}
+	if xCache["MISS"] != 1 || xCache["COALESCED"] != 9 {
+		t.Errorf("X-Cache counts = %v, want one MISS and nine COALESCED", xCache)
+	}
+	after := getCoalesceStats()
+	if after.Leaders-before.Leaders != 1 || after.Coalesced-before.Coalesced != 9 || after.InFlight != 0 {
+		t.Errorf("stats went from %+v to %+v", before, after)
+	}
+}
+
+func TestCoalescedErrorsAreSharedAndNotStored(t *testing.T) {
+	backend := newBlockingBackend(http.StatusBadGateway)
+	handler := useCoalescingCache(t, backend)
+	before := getCoalesceStats()
+
+	for _, rec := range getConcurrently(handler, backend, 5) {
+		if rec.Code != http.StatusBadGateway {
+			t.Errorf("status = %d, want the leader's 502", rec.Code)
+		}
+	}
+	if backend.calls.Load() != 1 {
+		t.Errorf("backend called %d times, want 1", backend.calls.Load())
+	}
+	if after := getCoalesceStats(); after.LeaderErrors-before.LeaderErrors != 1 {
+		t.Errorf("leader errors went from %d to %d", before.LeaderErrors, after.LeaderErrors)
+	}
+
+	// the error wasn't cached, so the next request calls the backend again
+	if rec := get(handler, coalescedTarget); rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("X-Cache = %q, want MISS", rec.Header().Get("X-Cache"))
+	}
+	if backend.calls.Load() != 2 {
+		t.Errorf("backend called %d times, want 2", backend.calls.Load())
+	}
+}
+
+func TestLeaderDisconnectStillAnswersWaiters(t *testing.T) {
+	backend := newBlockingBackend(http.StatusOK)
+	handler := useCoalescingCache(t, backend)
+	before := getCoalesceStats()
+
+	ctx, disconnect := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", coalescedTarget, nil).WithContext(ctx))
+	}()
+	<-backend.started
+
+	waiter := httptest.NewRecorder()
+	waiterDone := make(chan struct{})
+	go func() {
+		defer close(waiterDone)
+		handler.ServeHTTP(waiter, httptest.NewRequest("GET", coalescedTarget, nil))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	disconnect()
+	close(backend.release)
+	<-leaderDone
+	<-waiterDone
+
+	if waiter.Code != http.StatusOK || waiter.Header().Get("X-Cache") != "COALESCED" {
+		t.Errorf("waiter got %d with X-Cache %q", waiter.Code, waiter.Header().Get("X-Cache"))
+	}
+	if after := getCoalesceStats(); after.DetachedLeaders-before.DetachedLeaders != 1 {
+		t.Errorf("detached leaders went from %d to %d", before.DetachedLeaders, after.DetachedLeaders)
+	}
+	if rec := get(handler, coalescedTarget); rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("X-Cache = %q, want the detached leader's response cached", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestCancelledWaiterIsAbandoned(t *testing.T) {
+	backend := newBlockingBackend(http.StatusOK)
+	handler := useCoalescingCache(t, backend)
+	before := getCoalesceStats()
+
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", coalescedTarget, nil))
+	}()
+	<-backend.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	waiter := httptest.NewRecorder()
+	handler.ServeHTTP(waiter, httptest.NewRequest("GET", coalescedTarget, nil).WithContext(ctx))
+	close(backend.release)
+	<-leaderDone
+
+	if waiter.Body.Len() != 0 || waiter.Header().Get("X-Cache") != "" {
+		t.Errorf("cancelled waiter was answered: %d %q", waiter.Code, waiter.Body)
+	}
+	after := getCoalesceStats()
+	if after.Abandoned-before.Abandoned != 1 || after.Coalesced != before.Coalesced {
+		t.Errorf("stats went from %+v to %+v", before, after)
+	}
+	if backend.calls.Load() != 1 {
+		t.Errorf("backend called %d times, want 1", backend.calls.Load())
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// errWrongCacheKey is returned when an entry was sealed under another key
+var errWrongCacheKey = errors.New("cache entry was written under a different encryption key")
+
+// cacheCipher seals cache entries with AES-256-GCM and derives their storage
+// keys with HMAC-SHA256, so neither responses nor the emails and passwords in
+// request paths are readable from the database file. Both keys are derived
+// from one master key.
+type cacheCipher struct {
+	id   string
+	aead cipher.AEAD
+	mac  []byte
+}
+
+// sealedEntry is the encrypted part of a CacheEntry. The request key is kept
+// so entries can be re-keyed when the master key is rotated.
+type sealedEntry struct {
+	Key     string            `json:"key"`
+	Headers map[string]string `json:"headers"`
+	Body    []byte            `json:"body"`
+}
+
+func newCacheCipher(master []byte) (*cacheCipher, error) {
+	if len(master) != 32 {
+		return nil, fmt.Errorf("cache encryption key must be 32 bytes, got %d", len(master))
+	}
+	block, err := aes.NewCipher(derive(master, "passdb cache encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheCipher{
+		id:   hex.EncodeToString(derive(master, "passdb cache key id")[:8]),
+		aead: aead,
+		mac:  derive(master, "passdb cache keys"),
+	}, nil
+}
+
+func derive(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// storageKey maps a request key to the key it's stored under, keeping the
+// version prefix readable so old versions can still be purged
+func (c *cacheCipher) storageKey(key string, config CacheConfig) string {
+	mac := hmac.New(sha256.New, c.mac)
+	mac.Write([]byte(key))
+	return cacheKeyPrefix(config) + hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts the headers, body and request key of entry into its Sealed
+// field, bound to the key it's stored under
+func (c *cacheCipher) seal(entry *CacheEntry, key, storageKey string) error {
+	plaintext, err := json.Marshal(sealedEntry{Key: key, Headers: entry.Headers, Body: entry.Body})
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	entry.Sealed = c.aead.Seal(nonce, nonce, plaintext, []byte(storageKey))
+	entry.KeyID = c.id
+	entry.Headers, entry.Body = nil, nil
+	return nil
+}
+
+// open decrypts a sealed entry in place, returning its request key
+func (c *cacheCipher) open(entry *CacheEntry, storageKey string) (string, error) {
+	if entry.KeyID != c.id {
+		return "", errWrongCacheKey
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(entry.Sealed) < nonceSize {
+		return "", fmt.Errorf("cache entry is too short to be sealed")
+	}
+	plaintext, err := c.aead.Open(nil, entry.Sealed[:nonceSize], entry.Sealed[nonceSize:], []byte(storageKey))
+	if err != nil {
+		return "", err
+	}
+
+	var sealed sealedEntry
+	if err := json.Unmarshal(plaintext, &sealed); err != nil {
+		return "", err
+	}
+	entry.Headers, entry.Body, entry.Sealed = sealed.Headers, sealed.Body, nil
+	return sealed.Key, nil
+}
+
+// loadCacheCiphers reads the current master key and any previous ones from
+// CACHE_ENCRYPTION_KEY or CACHE_ENCRYPTION_KEY_FILE and
+// CACHE_ENCRYPTION_PREVIOUS_KEYS. The current cipher is nil when encryption
+// isn't configured.
+func loadCacheCiphers(config CacheConfig) (current *cacheCipher, previous []*cacheCipher, err error) {
+	keyText := config.EncryptionKey
+	if keyText == "" && config.EncryptionKeyFile != "" {
+		data, err := os.ReadFile(config.EncryptionKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(data) == 32 {
+			keyText = base64.StdEncoding.EncodeToString(data)
+		} else {
+			keyText = string(bytes.TrimSpace(data))
+		}
+	}
+	if keyText == "" {
+		return nil, nil, nil
+	}
+
+	if current, err = parseCacheKey(keyText); err != nil {
+		return nil, nil, err
+	}
+	for _, keyText := range config.PreviousEncryptionKeys {
+		old, err := parseCacheKey(keyText)
+		if err != nil {
+			return nil, nil, fmt.Errorf("previous %w", err)
+		}
+		previous = append(previous, old)
+	}
+	return current, previous, nil
+}
+
+// parseCacheKey accepts a 32 byte key encoded as hex or base64
+func parseCacheKey(text string) (*cacheCipher, error) {
+	text = strings.TrimSpace(text)
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return newCacheCipher(key)
+	}
+	key, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return nil, fmt.Errorf("cache encryption key must be hex or base64")
+	}
+	return newCacheCipher(key)
+}
+
+// checkCacheKey makes sure the cache only holds entries readable with the
+// current key. Entries written under a previous key are re-encrypted; any
+// others, including unencrypted entries when encryption has been turned on,
+// are deleted. The entries are only checked when the key ID recorded in the
+// store differs from the current one, so a shared store isn't scanned by
+// every replica on startup. It reports whether any entries were rewritten
+// or deleted.
+func checkCacheKey(store CacheStore, config CacheConfig, current *cacheCipher, previous []*cacheCipher) (bool, error) {
+	currentID := ""
+	if current != nil {
+		currentID = current.id
+	}
+
+	storedID, recorded, err := store.KeyID()
+	if err != nil {
+		return false, err
+	}
+	if recorded && storedID == currentID {
+		return false, nil
+	}
+	if !recorded && current == nil {
+		// an unencrypted cache from before keys were recorded
+		return false, store.SetKeyID("")
+	}
+
+	previousByID := make(map[string]*cacheCipher)
+	for _, old := range previous {
+		previousByID[old.id] = old
+	}
+
+	type rekeyed struct {
+		key   string
+		value []byte
+		ttl   time.Duration
+	}
+	var stale []string
+	var rewrites []rekeyed
+	now := time.Now()
+	err = store.Scan("", func(k string, v []byte) error {
+		var entry CacheEntry
+		if err := json.Unmarshal(v, &entry); err == nil && entry.KeyID == currentID {
+			return nil
+		}
+		stale = append(stale, k)
+
+		old, ok := previousByID[entry.KeyID]
+		remaining := entry.TTL + entry.Stale - now.Sub(entry.Timestamp)
+		if current == nil || !ok || remaining <= 0 {
+			return nil
+		}
+		key, err := old.open(&entry, k)
+		// entries from an earlier key version would be stored under a
+		// key no request looks up any more
+		if err != nil || !strings.HasPrefix(key, cacheKeyPrefix(config)) {
+			return nil
+		}
+		storageKey := current.storageKey(key, config)
+		if err := current.seal(&entry, key, storageKey); err != nil {
+			return err
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		rewrites = append(rewrites, rekeyed{storageKey, data, remaining})
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if err := store.Delete(stale...); err != nil {
+		return false, err
+	}
+	for _, rewrite := range rewrites {
+		if err := store.Set(rewrite.key, rewrite.value, rewrite.ttl); err != nil {
+			return false, err
+		}
+	}
+	if err := store.SetKeyID(currentID); err != nil {
+		return false, err
+	}
+
+	if len(stale) > 0 {
+		log.Printf("Cache encryption key changed: re-encrypted %d entries, dropped %d", len(rewrites), len(stale)-len(rewrites))
+	}
+	return len(stale) > 0, nil
+}
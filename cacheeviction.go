@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// cacheAccessBucket holds an entryAccess for every key in the cache
+	// bucket, kept apart so recording a hit doesn't rewrite the entry
+	cacheAccessBucket = "cache_access"
+
+	// cacheMetaBucket holds the running total size of the cache and the ID
+	// of the key its entries are encrypted under
+	cacheMetaBucket = "cache_meta"
+	cacheSizeKey    = "total_size"
+	cacheKeyIDKey   = "key_id"
+
+	evictLRU = "lru"
+	evictLFU = "lfu"
+
+	// evictionTarget is the fraction of CacheConfig.MaxSize evictions bring
+	// the cache down to, so each eviction pass frees room for many entries
+	evictionTarget = 0.9
+)
+
+// entryAccess tracks how an entry is used, for eviction
+type entryAccess struct {
+	LastHit time.Time `json:"last_hit"`
+	Hits    int64     `json:"hits"`
+	Size    int64     `json:"size"`
+}
+
+// EvictionStats counts entries dropped or refused to keep the cache within
+// its size limits
+type EvictionStats struct {
+	Evictions      int64 `json:"evictions"`
+	EvictedBytes   int64 `json:"evicted_bytes"`
+	RejectedTooBig int64 `json:"rejected_too_big"`
+}
+
+var (
+	evictionMu    sync.Mutex
+	evictionStats EvictionStats
+
+	// evicting is set while an eviction pass runs, so misses arriving
+	// meanwhile don't start another
+	evicting atomic.Bool
+)
+
+func getEvictionStats() EvictionStats {
+	evictionMu.Lock()
+	defer evictionMu.Unlock()
+	return evictionStats
+}
+
+// createCacheBuckets creates the buckets the cache uses
+func createCacheBuckets(tx *bbolt.Tx) error {
+	for _, name := range []string{"cache", cacheAccessBucket, cacheMetaBucket} {
+		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putEntry stores an encoded entry along with fresh access tracking,
+// keeping the total size up to date
+func putEntry(tx *bbolt.Tx, key, data []byte) error {
+	if err := deleteEntry(tx, key); err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte("cache")).Put(key, data); err != nil {
+		return err
+	}
+
+	access := entryAccess{LastHit: time.Now(), Size: int64(len(key) + len(data))}
+	if err := putAccess(tx, key, access); err != nil {
+		return err
+	}
+	return addTotalSize(tx, access.Size)
+}
+
+// deleteEntry removes an entry and its access tracking, if present
+func deleteEntry(tx *bbolt.Tx, key []byte) error {
+	access, err := getAccess(tx, key)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte("cache")).Delete(key); err != nil {
+		return err
+	}
+	if access == nil {
+		return nil
+	}
+	if err := tx.Bucket([]byte(cacheAccessBucket)).Delete(key); err != nil {
+		return err
+	}
+	return addTotalSize(tx, -access.Size)
+}
+
+func getAccess(tx *bbolt.Tx, key []byte) (*entryAccess, error) {
+	data := tx.Bucket([]byte(cacheAccessBucket)).Get(key)
+	if data == nil {
+		return nil, nil
+	}
+	access := &entryAccess{}
+	return access, json.Unmarshal(data, access)
+}
+
+func putAccess(tx *bbolt.Tx, key []byte, access entryAccess) error {
+	data, err := json.Marshal(access)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(cacheAccessBucket)).Put(key, data)
+}
+
+func totalSize(tx *bbolt.Tx) int64 {
+	data := tx.Bucket([]byte(cacheMetaBucket)).Get([]byte(cacheSizeKey))
+	if len(data) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(data))
+}
+
+func addTotalSize(tx *bbolt.Tx, delta int64) error {
+	size := max(totalSize(tx)+delta, 0)
+	return tx.Bucket([]byte(cacheMetaBucket)).Put(
+		[]byte(cacheSizeKey),
+		binary.BigEndian.AppendUint64(nil, uint64(size)),
+	)
+}
+
+// reconcileCacheSizes rebuilds the access tracking and total size from the
+// entries themselves, covering entries cached before sizes were tracked
+func reconcileCacheSizes(db *bbolt.DB) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		var total int64
+		err := tx.Bucket([]byte("cache")).ForEach(func(k, v []byte) error {
+			size := int64(len(k) + len(v))
+			total += size
+
+			access, err := getAccess(tx, k)
+			if err == nil && access != nil && access.Size == size {
+				return nil
+			}
+			var header cacheEntryHeader
+			json.Unmarshal(v, &header)
+			return putAccess(tx, k, entryAccess{LastHit: header.Timestamp, Size: size})
+		})
+		if err != nil {
+			return err
+		}
+
+		// drop tracking left behind for entries that no longer exist
+		access := tx.Bucket([]byte(cacheAccessBucket))
+		entries := tx.Bucket([]byte("cache"))
+		var orphans [][]byte
+		access.ForEach(func(k, v []byte) error {
+			if entries.Get(k) == nil {
+				orphans = append(orphans, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, key := range orphans {
+			if err := access.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket([]byte(cacheMetaBucket)).Put(
+			[]byte(cacheSizeKey),
+			binary.BigEndian.AppendUint64(nil, uint64(total)),
+		)
+	})
+}
+
+// RecordHit updates an entry's access tracking. Hits from concurrent
+// requests share a write transaction.
+func (c *boltCache) RecordHit(key string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	err := c.db.Batch(func(tx *bbolt.Tx) error {
+		access, err := getAccess(tx, []byte(key))
+		if err != nil || access == nil {
+			return err
+		}
+		access.LastHit = time.Now()
+		access.Hits++
+		return putAccess(tx, []byte(key), *access)
+	})
+	if err != nil {
+		log.Printf("Failed to record cache hit: %v", err)
+	}
+}
+
+// evict deletes entries by the configured policy until the cache is back
+// under evictionTarget of its maximum size. Expired entries always go first.
+func (c *boltCache) evict(config CacheConfig) error {
+	type candidate struct {
+		key     []byte
+		expired bool
+		access  entryAccess
+	}
+
+	now := time.Now()
+	var candidates []candidate
+	var size int64
+	err := c.View(func(tx *bbolt.Tx) error {
+		size = totalSize(tx)
+		entries := tx.Bucket([]byte("cache"))
+		return tx.Bucket([]byte(cacheAccessBucket)).ForEach(func(k, v []byte) error {
+			var access entryAccess
+			if err := json.Unmarshal(v, &access); err != nil {
+				return err
+			}
+			candidates = append(candidates, candidate{
+				key:     append([]byte{}, k...),
+				expired: entryExpired(entries.Get(k), now),
+				access:  access,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.expired != b.expired {
+			return a.expired
+		}
+		if config.EvictionPolicy == evictLFU && a.access.Hits != b.access.Hits {
+			return a.access.Hits < b.access.Hits
+		}
+		return a.access.LastHit.Before(b.access.LastHit)
+	})
+
+	target := int64(float64(config.MaxSize) * evictionTarget)
+	var victims [][]byte
+	for _, candidate := range candidates {
+		if size <= target {
+			break
+		}
+		victims = append(victims, candidate.key)
+		size -= candidate.access.Size
+	}
+
+	var evicted, evictedBytes int64
+	err = c.Update(func(tx *bbolt.Tx) error {
+		for _, key := range victims {
+			access, err := getAccess(tx, key)
+			if err != nil {
+				return err
+			}
+			if access == nil {
+				// deleted since the scan
+				continue
+			}
+			if err := deleteEntry(tx, key); err != nil {
+				return err
+			}
+			evicted++
+			evictedBytes += access.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	evictionMu.Lock()
+	evictionStats.Evictions += evicted
+	evictionStats.EvictedBytes += evictedBytes
+	evictionMu.Unlock()
+	log.Printf("Evicted %d cache entries (%d bytes)", evicted, evictedBytes)
+	return nil
+}
+
+// getEnvSize parses a size in bytes with an optional KB, MB or GB suffix
+func getEnvSize(key string, defaultValue int64) int64 {
+	value := strings.ToUpper(strings.TrimSpace(getEnv(key, "")))
+	if value == "" {
+		return defaultValue
+	}
+	size, err := parseSize(value)
+	if err != nil {
+		log.Printf("Ignoring %s: %v", key, err)
+		return defaultValue
+	}
+	return size
+}
+
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// compactTxSize is how much data compaction copies per write transaction
+	compactTxSize = 64 << 20
+
+	// reopenAttempts is how many times compaction tries to reopen the
+	// database before giving up until the next compaction
+	reopenAttempts = 3
+)
+
+// reopenBackoff is how long compaction waits between attempts to reopen the
+// database
+var reopenBackoff = time.Second
+
+// cacheEntryHeader is the part of a CacheEntry needed to tell whether it has
+// expired, decoded without the body
+type cacheEntryHeader struct {
+	Timestamp time.Time     `json:"timestamp"`
+	TTL       time.Duration `json:"ttl"`
+	Stale     time.Duration `json:"stale"`
+	Route     string        `json:"route"`
+}
+
+// JanitorStats describes the work of the cache sweeper and compactor
+type JanitorStats struct {
+	Sweeps         int64      `json:"sweeps"`
+	EntriesSwept   int64      `json:"entries_swept"`
+	LastSweep      *time.Time `json:"last_sweep,omitempty"`
+	Compactions    int64      `json:"compactions"`
+	ReclaimedBytes int64      `json:"reclaimed_bytes"`
+	LastCompaction *time.Time `json:"last_compaction,omitempty"`
+}
+
+var (
+	janitorMu    sync.Mutex
+	janitorStats JanitorStats
+)
+
+func getJanitorStats() JanitorStats {
+	janitorMu.Lock()
+	defer janitorMu.Unlock()
+	return janitorStats
+}
+
+// entryExpired reports whether the encoded cache entry has outlived its TTL
+// and the time it may be served stale after that. Entries that can't be
+// decoded count as expired so they get cleaned up.
+func entryExpired(data []byte, now time.Time) bool {
+	var header cacheEntryHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return true
+	}
+	return now.Sub(header.Timestamp) >= header.TTL+header.Stale
+}
+
+// sweepPeriodically deletes expired entries every config.SweepInterval
+func sweepPeriodically(store sweeper, config CacheConfig) {
+	if config.SweepInterval <= 0 {
+		return
+	}
+	for range time.Tick(config.SweepInterval) {
+		swept, err := store.sweep(config.SweepBatch)
+		if err != nil {
+			log.Printf("Failed to sweep cache: %v", err)
+		}
+		if swept > 0 {
+			log.Printf("Swept %d expired cache entries", swept)
+		}
+	}
+}
+
+// sweep deletes expired entries, examining at most batch entries per write
+// transaction so requests aren't held up behind one long transaction
+func (c *boltCache) sweep(batch int) (int, error) {
+	if batch <= 0 {
+		batch = 1000
+	}
+
+	now := time.Now()
+	swept := 0
+	var resume []byte
+	for {
+		var next []byte
+		err := c.Update(func(tx *bbolt.Tx) error {
+			bucket := tx.Bucket([]byte("cache"))
+			cursor := bucket.Cursor()
+
+			k, v := cursor.First()
+			if resume != nil {
+				k, v = cursor.Seek(resume)
+			}
+
+			var expired [][]byte
+			for n := 0; k != nil && n < batch; n++ {
+				if entryExpired(v, now) {
+					expired = append(expired, append([]byte{}, k...))
+				}
+				k, v = cursor.Next()
+			}
+			if k != nil {
+				next = append([]byte{}, k...)
+			}
+
+			for _, key := range expired {
+				if err := deleteEntry(tx, key); err != nil {
+					return err
+				}
+			}
+			swept += len(expired)
+			return nil
+		})
+		if err != nil {
+			return swept, err
+		}
+		if next == nil {
+			break
+		}
+		resume = next
+	}
+
+	recordSweep(swept, now)
+	return swept, nil
+}
+
+func recordSweep(swept int, now time.Time) {
+	janitorMu.Lock()
+	janitorStats.Sweeps++
+	janitorStats.EntriesSwept += int64(swept)
+	janitorStats.LastSweep = &now
+	janitorMu.Unlock()
+}
+
+// compactPeriodically rewrites the database every config.CompactInterval to
+// return the space freed by sweeps to the filesystem
+func (c *boltCache) compactPeriodically(config CacheConfig) {
+	if config.CompactInterval <= 0 {
+		return
+	}
+	for range time.Tick(config.CompactInterval) {
+		reclaimed, err := c.compact()
+		if err != nil {
+			log.Printf("Failed to compact cache: %v", err)
+			continue
+		}
+		log.Printf("Compacted cache, reclaiming %d bytes", reclaimed)
+	}
+}
+
+// compact copies the live data into a fresh file and swaps it in place of the
+// current one. Requests wait for the swap to finish.
+func (c *boltCache) compact() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closedErr != nil {
+		// an earlier compaction left the database closed; only reopen it
+		if err := c.reopen(); err != nil {
+			return 0, err
+		}
+		log.Printf("Reopened cache database %s, caching resumed", c.path)
+		return 0, nil
+	}
+
+	before, err := fileSize(c.path)
+	if err != nil {
+		return 0, err
+	}
+
+	compactPath := c.path + ".compacting"
+	os.Remove(compactPath)
+	dst, err := bbolt.Open(compactPath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return 0, err
+	}
+	if err := bbolt.Compact(dst, c.db, compactTxSize); err != nil {
+		dst.Close()
+		os.Remove(compactPath)
+		return 0, err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(compactPath)
+		return 0, err
+	}
+
+	if err := c.db.Close(); err != nil {
+		os.Remove(compactPath)
+		return 0, err
+	}
+	renameErr := os.Rename(compactPath, c.path)
+	if renameErr != nil {
+		os.Remove(compactPath)
+	}
+
+	// reopen whichever file is now in place, so a failed swap leaves the
+	// uncompacted cache working
+	if err := c.reopen(); err != nil {
+		log.Printf("CACHE DISABLED: failed to reopen %s after compaction, bypassing the cache until it can be reopened: %v", c.path, err)
+		return 0, err
+	}
+	if renameErr != nil {
+		return 0, renameErr
+	}
+
+	after, err := fileSize(c.path)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	janitorMu.Lock()
+	janitorStats.Compactions++
+	janitorStats.ReclaimedBytes += before - after
+	janitorStats.LastCompaction = &now
+	janitorMu.Unlock()
+	return before - after, nil
+}
+
+// reopen opens the database at c.path again, retrying a few times. If every
+// attempt fails the store is marked unusable, so the middleware bypasses it
+// and the health check reports it. c.mu must be held.
+func (c *boltCache) reopen() error {
+	var err error
+	for attempt := range reopenAttempts {
+		if attempt > 0 {
+			time.Sleep(reopenBackoff)
+		}
+		var db *bbolt.DB
+		if db, err = bbolt.Open(c.path, 0600, &bbolt.Options{Timeout: 1 * time.Second}); err == nil {
+			c.db, c.closedErr = db, nil
+			return nil
+		}
+	}
+	c.closedErr = fmt.Errorf("cache database is closed: reopening %s failed: %w", c.path, err)
+	return err
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
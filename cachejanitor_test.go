@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestBolt(t *testing.T) *boltCache {
+	t.Helper()
+	store, err := openBoltCache(CacheConfig{Backend: backendBolt, DBPath: filepath.Join(t.TempDir(), "cache.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// breakBolt closes the database and puts a directory in its place, so
+// reopening it fails until the returned function restores the file
+func breakBolt(t *testing.T, store *boltCache) (restore func()) {
+	t.Helper()
+	previous := reopenBackoff
+	reopenBackoff = 0
+	t.Cleanup(func() { reopenBackoff = previous })
+
+	moved := store.path + ".moved"
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(store.path, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(store.path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.reopen(); err == nil {
+		t.Fatal("reopened a directory")
+	}
+	return func() {
+		if err := os.Remove(store.path); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(moved, store.path); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompactKeepsEntries(t *testing.T) {
+	store := openTestBolt(t)
+	value := make([]byte, 4096)
+	for i := range 500 {
+		if err := store.Set(fmt.Sprintf("v1:GET:/%d", i), value, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetKeyID("key"); err != nil {
+		t.Fatal(err)
+	}
+	// free most of the pages so there's space to reclaim
+	for i := range 400 {
+		if err := store.Delete(fmt.Sprintf("v1:GET:/%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reclaimed, err := store.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed <= 0 {
+		t.Errorf("reclaimed %d bytes, want the freed pages returned", reclaimed)
+	}
+
+	for i := range 500 {
+		got, err := store.Get(fmt.Sprintf("v1:GET:/%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i >= 400; (got != nil) != want || (want && len(got) != len(value)) {
+			t.Fatalf("entry %d after compaction = %d bytes", i, len(got))
+		}
+	}
+	if id, ok, err := store.KeyID(); err != nil || !ok || id != "key" {
+		t.Errorf("key ID after compaction = %q, %v, %v", id, ok, err)
+	}
+	if stats, err := store.Stats(); err != nil || stats.Entries != 100 {
+		t.Errorf("stats after compaction = %+v, %v", stats, err)
+	}
+	if _, err := os.Stat(store.path + ".compacting"); !os.IsNotExist(err) {
+		t.Errorf("compaction left its temporary file behind: %v", err)
+	}
+}
+
+func TestFailedReopenMarksStoreUnusable(t *testing.T) {
+	store := openTestBolt(t)
+	if err := store.Set("v1:GET:/a", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	restore := breakBolt(t, store)
+	if store.healthy() == nil {
+		t.Fatal("store with a closed database reports healthy")
+	}
+	if _, err := store.Get("v1:GET:/a"); err == nil {
+		t.Error("read from a closed database")
+	}
+	if _, err := store.compact(); err == nil {
+		t.Error("compaction reopened a directory")
+	}
+
+	// the next compaction reopens the database once it can
+	restore()
+	if _, err := store.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.healthy(); err != nil {
+		t.Errorf("healthy after reopening = %v", err)
+	}
+	if got, err := store.Get("v1:GET:/a"); err != nil || string(got) != "value" {
+		t.Errorf("entry after reopening = %q, %v", got, err)
+	}
+}
+
+func TestMiddlewareBypassesUnusableStore(t *testing.T) {
+	config := testCacheConfig()
+	config.Backend = backendBolt
+	config.DBPath = filepath.Join(t.TempDir(), "cache.db")
+
+	calls := 0
+	handler := useCache(t, config, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"ok":true}`))
+	})
+	breakBolt(t, cacheDB.store.(*boltCache))
+
+	for range 2 {
+		rec := get(handler, "/api/v1/breaches/test@example.com")
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "" {
+			t.Errorf("got %d with X-Cache %q, want the cache bypassed", rec.Code, rec.Header().Get("X-Cache"))
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want every request served by the backend", calls)
+	}
+
+	rec := get(http.HandlerFunc(handleHealth), "/api/v1/health")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("health = %d %s, want the closed cache reported", rec.Code, rec.Body)
+	}
+}
+
+func TestReopenRetries(t *testing.T) {
+	store := openTestBolt(t)
+	previous := reopenBackoff
+	reopenBackoff = 10 * time.Millisecond
+	t.Cleanup(func() { reopenBackoff = previous })
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	moved := store.path + ".moved"
+	if err := os.Rename(store.path, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(store.path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// the file comes back while reopen is still retrying
+	go func() {
+		time.Sleep(reopenBackoff / 2)
+		os.Remove(store.path)
+		os.Rename(moved, store.path)
+	}()
+	if err := store.reopen(); err != nil || store.closedErr != nil {
+		t.Errorf("reopen = %v, want a later attempt to succeed", err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMemoryCacheSize bounds a memory cache when CACHE_MAX_SIZE isn't
+// set, so it can't grow until it takes the process down
+const defaultMemoryCacheSize = 256 << 20
+
+// memoryCache is a CacheStore held in process memory, bounded by
+// CacheConfig.MaxSize with the same eviction policies as boltCache. Its
+// entries are lost on restart.
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	size    int64
+	config  CacheConfig
+
+	keyID      string
+	keyIDIsSet bool
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+	access  entryAccess
+}
+
+func newMemoryCache(config CacheConfig) *memoryCache {
+	return &memoryCache{entries: make(map[string]*memoryEntry), config: config}
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+func (c *memoryCache) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	if entry.expired(time.Now()) {
+		c.deleteLocked(key)
+		return nil, nil
+	}
+	return entry.value, nil
+}
+
+// Set stores an entry, evicting others first if it takes the cache past its
+// maximum size
+func (c *memoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.deleteLocked(key)
+	entry := &memoryEntry{
+		value:  append([]byte{}, value...),
+		access: entryAccess{LastHit: now, Size: int64(len(key) + len(value))},
+	}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+	c.entries[key] = entry
+	c.size += entry.access.Size
+
+	if c.config.MaxSize > 0 && c.size > c.config.MaxSize {
+		c.evictLocked(now)
+	}
+	return nil
+}
+
+func (c *memoryCache) Delete(keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		c.deleteLocked(key)
+	}
+	return nil
+}
+
+func (c *memoryCache) deleteLocked(key string) {
+	if entry, ok := c.entries[key]; ok {
+		c.size -= entry.access.Size
+		delete(c.entries, key)
+	}
+}
+
+// Scan calls fn on a snapshot of the matching entries, so fn runs without
+// holding up other requests
+func (c *memoryCache) Scan(prefix string, fn func(key string, value []byte) error) error {
+	type match struct {
+		key   string
+		value []byte
+	}
+	now := time.Now()
+	var matches []match
+	c.mu.Lock()
+	for key, entry := range c.entries {
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+			matches = append(matches, match{key, entry.value})
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].key < matches[j].key })
+	for _, match := range matches {
+		if err := fn(match.key, match.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *memoryCache) KeyID() (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.keyID, c.keyIDIsSet, nil
+}
+
+func (c *memoryCache) SetKeyID(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keyID, c.keyIDIsSet = id, true
+	return nil
+}
+
+func (c *memoryCache) Stats() (StoreStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return StoreStats{Backend: backendMemory, Entries: len(c.entries), Size: c.size}, nil
+}
+
+func (c *memoryCache) Close() error {
+	return nil
+}
+
+func (c *memoryCache) RecordHit(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		entry.access.LastHit = time.Now()
+		entry.access.Hits++
+	}
+}
+
+// sweep deletes expired entries. Holding them all in memory already, it
+// doesn't need to work in batches.
+func (c *memoryCache) sweep(batch int) (int, error) {
+	c.mu.Lock()
+	now := time.Now()
+	swept := 0
+	for key, entry := range c.entries {
+		if entry.expired(now) {
+			c.deleteLocked(key)
+			swept++
+		}
+	}
+	c.mu.Unlock()
+
+	recordSweep(swept, now)
+	return swept, nil
+}
+
+// evictLocked deletes entries by the configured policy until the cache is
+// back under evictionTarget of its maximum size. Expired entries always go
+// first.
+func (c *memoryCache) evictLocked(now time.Time) {
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := c.entries[keys[i]], c.entries[keys[j]]
+		if a.expired(now) != b.expired(now) {
+			return a.expired(now)
+		}
+		if c.config.EvictionPolicy == evictLFU && a.access.Hits != b.access.Hits {
+			return a.access.Hits < b.access.Hits
+		}
+		return a.access.LastHit.Before(b.access.LastHit)
+	})
+
+	target := int64(float64(c.config.MaxSize) * evictionTarget)
+	var evicted, evictedBytes int64
+	for _, key := range keys {
+		if c.size <= target {
+			break
+		}
+		evictedBytes += c.entries[key].access.Size
+		evicted++
+		c.deleteLocked(key)
+	}
+
+	evictionMu.Lock()
+	evictionStats.Evictions += evicted
+	evictionStats.EvictedBytes += evictedBytes
+	evictionMu.Unlock()
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// redisPoolSize is how many idle connections redisCache keeps open
+	redisPoolSize = 16
+
+	// redisScanCount is how many keys each SCAN and MGET handles
+	redisScanCount = 500
+
+	// redisKeyIDKey holds the ID of the key entries are encrypted under,
+	// after the store's prefix. Scans skip it.
+	redisKeyIDKey = "meta:key_id"
+)
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisCache is a CacheStore on a Redis server, or anything speaking its
+// protocol, so the cache can be shared by several passdb replicas. Entries
+// expire with Redis TTLs, and evicting them under memory pressure is left to
+// the server's maxmemory policy.
+type redisCache struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+	timeout  time.Duration
+
+	// idle holds open connections for reuse
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// openRedisCache connects to config.RedisAddr, failing if the server can't be
+// reached
+func openRedisCache(config CacheConfig) (*redisCache, error) {
+	c := &redisCache{
+		addr:     config.RedisAddr,
+		password: config.RedisPassword,
+		db:       config.RedisDB,
+		prefix:   config.RedisPrefix,
+		timeout:  config.RedisTimeout,
+		idle:     make(chan *redisConn, redisPoolSize),
+	}
+	if _, err := c.do("PING"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *redisCache) Get(key string) ([]byte, error) {
+	reply, err := c.do("GET", c.prefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected GET reply %T", reply)
+	}
+	return value, nil
+}
+
+func (c *redisCache) Set(key string, value []byte, ttl time.Duration) error {
+	args := []interface{}{"SET", c.prefix + key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	_, err := c.do(args...)
+	return err
+}
+
+func (c *redisCache) Delete(keys ...string) error {
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), redisScanCount)]
+		keys = keys[len(batch):]
+
+		args := []interface{}{"DEL"}
+		for _, key := range batch {
+			args = append(args, c.prefix+key)
+		}
+		if _, err := c.do(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisCache) Scan(prefix string, fn func(key string, value []byte) error) error {
+	return c.scan(prefix, func(keys []string) error {
+		args := []interface{}{"MGET"}
+		for _, key := range keys {
+			args = append(args, c.prefix+key)
+		}
+		reply, err := c.do(args...)
+		if err != nil {
+			return err
+		}
+		values, _ := reply.([]interface{})
+		for i, key := range keys {
+			// keys can expire between SCAN and MGET
+			if i >= len(values) || values[i] == nil {
+				continue
+			}
+			value, ok := values[i].([]byte)
+			if !ok {
+				continue
+			}
+			if err := fn(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *redisCache) KeyID() (string, bool, error) {
+	reply, err := c.do("GET", c.prefix+redisKeyIDKey)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	id, ok := reply.([]byte)
+	if !ok {
+		return "", false, fmt.Errorf("redis: unexpected GET reply %T", reply)
+	}
+	return string(id), true, nil
+}
+
+func (c *redisCache) SetKeyID(id string) error {
+	_, err := c.do("SET", c.prefix+redisKeyIDKey, id)
+	return err
+}
+
+// scan calls fn with each batch of keys starting with prefix, without the
+// store's own prefix. SCAN can return a key more than once, so keys already
+// seen are skipped, as is the key ID.
+func (c *redisCache) scan(prefix string, fn func(keys []string) error) error {
+	match := redisGlobEscape(c.prefix+prefix) + "*"
+	seen := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", match, "COUNT", strconv.Itoa(redisScanCount))
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("redis: unexpected SCAN reply")
+		}
+		next, _ := parts[0].([]byte)
+		found, _ := parts[1].([]interface{})
+
+		var keys []string
+		for _, item := range found {
+			raw, _ := item.([]byte)
+			key := strings.TrimPrefix(string(raw), c.prefix)
+			if raw != nil && !seen[key] && key != redisKeyIDKey {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+func (c *redisCache) Stats() (StoreStats, error) {
+	stats := StoreStats{Backend: backendRedis}
+	err := c.scan("", func(keys []string) error {
+		stats.Entries += len(keys)
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	reply, err := c.do("INFO", "memory")
+	if err != nil {
+		return stats, err
+	}
+	info, _ := reply.([]byte)
+	for _, line := range strings.Split(string(info), "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), "used_memory:"); ok {
+			stats.Size, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return stats, nil
+}
+
+func (c *redisCache) Close() error {
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends a command and returns its reply: nil, a string for status
+// replies, an int64, a []byte or a []interface{}
+func (c *redisCache) do(args ...interface{}) (interface{}, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.do(c.timeout, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// the connection is in an unknown state
+		conn.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+	return reply, err
+}
+
+// conn takes an idle connection, or dials a new one
+func (c *redisCache) conn() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	netConn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+	if c.password != "" {
+		if _, err := conn.do(c.timeout, "AUTH", c.password); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do(c.timeout, "SELECT", strconv.Itoa(c.db)); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (rc *redisConn) do(timeout time.Duration, args ...interface{}) (interface{}, error) {
+	if timeout > 0 {
+		rc.conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var data []byte
+		switch arg := arg.(type) {
+		case string:
+			data = []byte(arg)
+		case []byte:
+			data = arg
+		default:
+			return nil, fmt.Errorf("redis: unsupported argument type %T", arg)
+		}
+		fmt.Fprintf(&buf, "$%d\r\n", len(data))
+		buf.Write(data)
+		buf.WriteString("\r\n")
+	}
+	if _, err := rc.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return readRESP(rc.reader)
+}
+
+// readRESP reads one reply in the Redis serialization protocol
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	kind, rest := line[0], line[1:]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", rest)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad array length %q", rest)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				var replyErr redisError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
+
+// redisGlobEscape escapes the characters SCAN MATCH treats as wildcards
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server, speaking just
+// enough of the protocol for redisCache
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	data     map[string]fakeRedisValue
+	commands []string
+	pxs      map[string]int64
+}
+
+type fakeRedisValue struct {
+	value   []byte
+	expires time.Time
+}
+
+// fakeRedisPage is how many keys each SCAN returns, kept small so tests
+// cover the cursor
+const fakeRedisPage = 2
+
+// newFakeRedis starts a stand-in server, requiring AUTH if password is set
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeRedis{
+		listener: listener,
+		password: password,
+		data:     make(map[string]fakeRedisValue),
+		pxs:      make(map[string]int64),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.serve()
+	return server
+}
+
+func (s *fakeRedis) addr() string {
+	return s.listener.Addr().String()
+}
+
+// called counts the commands named name the server has handled
+func (s *fakeRedis) called(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, command := range s.commands {
+		if command == name {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		request, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		items, _ := request.([]interface{})
+		var args []string
+		for _, item := range items {
+			raw, _ := item.([]byte)
+			args = append(args, string(raw))
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		name := strings.ToUpper(args[0])
+		if name == "AUTH" {
+			authed = len(args) == 2 && args[1] == s.password
+		}
+		var reply string
+		if !authed && name != "AUTH" {
+			reply = "-NOAUTH Authentication required.\r\n"
+		} else {
+			reply = s.exec(name, args[1:])
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedis) exec(name string, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, name)
+	now := time.Now()
+
+	switch name {
+	case "PING", "SELECT":
+		return "+OK\r\n"
+	case "AUTH":
+		if len(args) == 1 && args[0] == s.password {
+			return "+OK\r\n"
+		}
+		return "-WRONGPASS invalid password\r\n"
+	case "GET":
+		return bulk(s.get(args[0], now))
+	case "SET":
+		value := fakeRedisValue{value: []byte(args[1])}
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			px, err := strconv.ParseInt(args[3], 10, 64)
+			if err != nil || px <= 0 {
+				return "-ERR invalid expire time\r\n"
+			}
+			s.pxs[args[0]] = px
+			value.expires = now.Add(time.Duration(px) * time.Millisecond)
+		}
+		s.data[args[0]] = value
+		return "+OK\r\n"
+	case "DEL":
+		deleted := 0
+		for _, key := range args {
+			if s.get(key, now) != nil {
+				deleted++
+			}
+			delete(s.data, key)
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	case "MGET":
+		reply := fmt.Sprintf("*%d\r\n", len(args))
+		for _, key := range args {
+			reply += bulk(s.get(key, now))
+		}
+		return reply
+	case "SCAN":
+		return s.scan(args, now)
+	case "INFO":
+		return bulk([]byte("# Memory\r\nused_memory:4096\r\nused_memory_human:4.00K\r\n"))
+	default:
+		return "-ERR unknown command '" + name + "'\r\n"
+	}
+}
+
+func (s *fakeRedis) get(key string, now time.Time) []byte {
+	value, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+	if !value.expires.IsZero() && !now.Before(value.expires) {
+		delete(s.data, key)
+		return nil
+	}
+	return value.value
+}
+
+// scan pages through the matching keys in sorted order, the cursor being the
+// index of the next key
+func (s *fakeRedis) scan(args []string, now time.Time) string {
+	cursor, _ := strconv.Atoi(args[0])
+	match := "*"
+	for i := 1; i+1 < len(args); i += 2 {
+		if strings.ToUpper(args[i]) == "MATCH" {
+			match = args[i+1]
+		}
+	}
+
+	var keys []string
+	for key := range s.data {
+		if globMatch(match, key) && s.get(key, now) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	end := min(cursor+fakeRedisPage, len(keys))
+	next := strconv.Itoa(end)
+	if end >= len(keys) {
+		next = "0"
+	}
+	page := keys[min(cursor, len(keys)):end]
+	reply := "*2\r\n" + bulk([]byte(next)) + fmt.Sprintf("*%d\r\n", len(page))
+	for _, key := range page {
+		reply += bulk([]byte(key))
+	}
+	return reply
+}
+
+// globMatch matches key against a SCAN MATCH pattern, in which "*" and "?"
+// match any characters, slashes included, and "\" escapes the next one
+func globMatch(pattern, key string) bool {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '*':
+			expr.WriteString("(?s:.*)")
+		case c == '?':
+			expr.WriteString("(?s:.)")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String()).MatchString(key)
+}
+
+func bulk(value []byte) string {
+	if value == nil {
+		return "$-1\r\n"
+	}
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func openTestRedis(t *testing.T, server *fakeRedis, config CacheConfig) *redisCache {
+	t.Helper()
+	config.RedisAddr = server.addr()
+	config.RedisPrefix = "passdb:test:"
+	config.RedisTimeout = time.Second
+	cache, err := openRedisCache(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	return cache
+}
+
+func TestRedisCacheSetsExpiry(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cache := openTestRedis(t, server, CacheConfig{})
+
+	if err := cache.Set("v1:a", []byte("a"), 90*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("v1:forever", []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("v1:short", []byte("c"), time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	pxs := server.pxs
+	server.mu.Unlock()
+	if pxs["passdb:test:v1:a"] != 90000 {
+		t.Errorf("PX = %d, want 90000", pxs["passdb:test:v1:a"])
+	}
+	if _, ok := pxs["passdb:test:v1:forever"]; ok {
+		t.Error("zero ttl was sent with PX")
+	}
+	if pxs["passdb:test:v1:short"] != 1 {
+		t.Errorf("PX = %d, want sub-millisecond ttls rounded up to 1", pxs["passdb:test:v1:short"])
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if value, err := cache.Get("v1:short"); err != nil || value != nil {
+		t.Errorf("expired entry: %q, %v", value, err)
+	}
+	if value, err := cache.Get("v1:forever"); err != nil || string(value) != "b" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+}
+
+func TestRedisCacheScanPagesAndMGETs(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cache := openTestRedis(t, server, CacheConfig{})
+	want := map[string]string{}
+	for i := range 5 {
+		key := fmt.Sprintf("v1:GET:/api/v1/breaches/%d", i)
+		want[key] = strconv.Itoa(i)
+		cache.Set(key, []byte(want[key]), 0)
+	}
+	cache.Set("v2:other", []byte("x"), 0)
+	cache.SetKeyID("abc")
+
+	// a key outside the store's prefix isn't touched
+	server.mu.Lock()
+	server.data["elsewhere:v1:x"] = fakeRedisValue{value: []byte("x")}
+	server.mu.Unlock()
+
+	got := map[string]string{}
+	err := cache.Scan("v1:", func(key string, value []byte) error {
+		got[key] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Scan = %v, want %v", got, want)
+	}
+	if scans := server.called("SCAN"); scans != 3 {
+		t.Errorf("%d SCAN calls, want 3 pages of %d", scans, fakeRedisPage)
+	}
+	if mgets := server.called("MGET"); mgets != 3 {
+		t.Errorf("%d MGET calls, want one per page", mgets)
+	}
+
+	stats, err := cache.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Backend != backendRedis || stats.Entries != 6 || stats.Size != 4096 {
+		t.Errorf("Stats = %+v, want 6 entries, not counting the key ID, and used_memory", stats)
+	}
+}
+
+func TestRedisCacheDeleteBatches(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cache := openTestRedis(t, server, CacheConfig{})
+	var keys []string
+	server.mu.Lock()
+	for i := range redisScanCount + 1 {
+		key := fmt.Sprintf("v1:%d", i)
+		keys = append(keys, key)
+		server.data["passdb:test:"+key] = fakeRedisValue{value: []byte("x")}
+	}
+	server.mu.Unlock()
+
+	if err := cache.Delete(keys...); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	left := len(server.data)
+	server.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d keys left", left)
+	}
+	if dels := server.called("DEL"); dels != 2 {
+		t.Errorf("%d DEL calls, want keys sent %d at a time", dels, redisScanCount)
+	}
+}
+
+func TestRedisCacheAuthenticates(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+
+	config := CacheConfig{RedisAddr: server.addr(), RedisTimeout: time.Second, RedisPassword: "wrong"}
+	if _, err := openRedisCache(config); err == nil {
+		t.Error("connected with the wrong password")
+	}
+
+	cache := openTestRedis(t, server, CacheConfig{RedisPassword: "secret", RedisDB: 2})
+	if err := cache.Set("v1:a", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if server.called("SELECT") == 0 {
+		t.Error("database wasn't selected")
+	}
+}
+
+func TestRedisCacheUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	if _, err := openRedisCache(CacheConfig{RedisAddr: addr, RedisTimeout: time.Second}); err == nil {
+		t.Error("opened a cache on a closed port")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// StaleStats counts expired entries served in place of a fresh response and
+// the background refreshes that replace them
+type StaleStats struct {
+	Served           int64 `json:"served"`
+	ServedOnError    int64 `json:"served_on_error"`
+	Refreshes        int64 `json:"refreshes"`
+	RefreshFailures  int64 `json:"refresh_failures"`
+	RefreshesSkipped int64 `json:"refreshes_skipped"`
+	Refreshing       int   `json:"refreshing"`
+}
+
+var (
+	staleMu    sync.Mutex
+	staleStats StaleStats
+
+	// refreshSlots bounds the number of background refreshes running at once
+	refreshSlots chan struct{}
+)
+
+func getStaleStats() StaleStats {
+	staleMu.Lock()
+	defer staleMu.Unlock()
+	return staleStats
+}
+
+func countStale(update func(stats *StaleStats)) {
+	staleMu.Lock()
+	update(&staleStats)
+	staleMu.Unlock()
+}
+
+// getStaleTTLForPath returns how long after expiring an entry for path may
+// still be served while it's refreshed in the background
+func getStaleTTLForPath(path string, config CacheConfig) time.Duration {
+	if routePattern, ok := matchRoute(path, config); ok {
+		if stale, ok := config.RouteStaleTTLs[routePattern]; ok {
+			return stale
+		}
+	}
+	return config.DefaultStaleTTL
+}
+
+// serveStaleOn reports whether a backend response with statusCode should be
+// replaced by a stale entry: server errors, including the 502s and 504s
+// hibpError maps upstream failures to, and HIBP rate limiting
+func serveStaleOn(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// writeCachedEntry answers a request from a cached entry
+func writeCachedEntry(w http.ResponseWriter, entry *CacheEntry, xCache string) {
+	for key, value := range entry.Headers {
+		w.Header().Set(key, value)
+	}
+	w.Header().Set("X-Cache", xCache)
+	w.WriteHeader(entry.StatusCode)
+	w.Write(entry.Body)
+}
+
+// refresh re-fetches a stale entry in the background with serve, unless
+// config.MaxRefreshes refreshes are already running. The refresh coalesces
+// with any misses for the same key.
+func refresh(r *http.Request, cacheKey string, serve func(*http.Request) *bufferedResponse, config CacheConfig) {
+	select {
+	case refreshSlots <- struct{}{}:
+	default:
+		countStale(func(stats *StaleStats) { stats.RefreshesSkipped++ })
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), config.RefreshTimeout)
+	// chi reuses a request's route context once it has been answered, so
+	// the refresh is routed with one of its own
+	ctx = context.WithValue(ctx, chi.RouteCtxKey, chi.NewRouteContext())
+	req := r.Clone(ctx)
+
+	countStale(func(stats *StaleStats) { stats.Refreshing++ })
+	go func() {
+		var resp *bufferedResponse
+		var err error
+		defer func() {
+			cancel()
+			<-refreshSlots
+			if recovered := recover(); recovered != nil {
+				log.Printf("CACHE REFRESH: %s (panic: %v)", cacheKey, recovered)
+				resp = nil
+			}
+
+			failed := err != nil || resp == nil || resp.statusCode < 200 || resp.statusCode >= 300
+			countStale(func(stats *StaleStats) {
+				stats.Refreshing--
+				stats.Refreshes++
+				if failed {
+					stats.RefreshFailures++
+				}
+			})
+		}()
+
+		if !config.Coalesce {
+			resp = serve(req)
+			return
+		}
+		resp, _, err = misses.do(ctx, cacheKey, func() *bufferedResponse {
+			return serve(req)
+		})
+	}()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errTestBackend = errors.New("backend failed")
+
+// putAged caches body for target as if it had been cached age ago for ttl
+func putAged(t *testing.T, config CacheConfig, target, body string, age, ttl time.Duration) {
+	t.Helper()
+	key := buildCacheKey(httptest.NewRequest("GET", target, nil), config)
+	entry := CacheEntry{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       []byte(body),
+		Timestamp:  time.Now().Add(-age),
+		TTL:        ttl,
+		Stale:      max(config.DefaultStaleTTL, config.StaleIfError),
+	}
+	if _, err := cacheDB.put(key, entry, config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForRefreshes waits until no background refreshes are running
+func waitForRefreshes(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for getStaleStats().Refreshing > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("refreshes didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStaleEntryIsServedAndRefreshed(t *testing.T) {
+	config := testCacheConfig()
+	config.DefaultStaleTTL = time.Hour
+	var calls atomic.Int32
+	handler := useCache(t, config, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`"new"`))
+	})
+	putAged(t, config, coalescedTarget, `"old"`, 90*time.Minute, time.Hour)
+	before := getStaleStats()
+
+	rec := get(handler, coalescedTarget)
+	if rec.Header().Get("X-Cache") != "STALE" || rec.Body.String() != `"old"` {
+		t.Errorf("got %q with X-Cache %q, want the stale entry", rec.Body, rec.Header().Get("X-Cache"))
+	}
+	waitForRefreshes(t)
+
+	if calls.Load() != 1 {
+		t.Errorf("backend called %d times, want one refresh", calls.Load())
+	}
+	after := getStaleStats()
+	if after.Served-before.Served != 1 || after.Refreshes-before.Refreshes != 1 || after.RefreshFailures != before.RefreshFailures {
+		t.Errorf("stats went from %+v to %+v", before, after)
+	}
+	rec = get(handler, coalescedTarget)
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != `"new"` {
+		t.Errorf("got %q with X-Cache %q, want the refreshed entry", rec.Body, rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestRefreshesAreLimited(t *testing.T) {
+	config := testCacheConfig()
+	config.DefaultStaleTTL = time.Hour
+	config.MaxRefreshes = 1
+	backend := newBlockingBackend(http.StatusOK)
+	handler := useCache(t, config, backend.ServeHTTP)
+	putAged(t, config, "/api/v1/breaches/a@example.com", `"a"`, 90*time.Minute, time.Hour)
+	putAged(t, config, "/api/v1/breaches/b@example.com", `"b"`, 90*time.Minute, time.Hour)
+	before := getStaleStats()
+
+	if rec := get(handler, "/api/v1/breaches/a@example.com"); rec.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("X-Cache = %q, want STALE", rec.Header().Get("X-Cache"))
+	}
+	<-backend.started
+
+	// the only refresh slot is taken, so this one is answered stale without
+	// a refresh
+	rec := get(handler, "/api/v1/breaches/b@example.com")
+	if rec.Header().Get("X-Cache") != "STALE" || rec.Body.String() != `"b"` {
+		t.Errorf("got %q with X-Cache %q, want the stale entry", rec.Body, rec.Header().Get("X-Cache"))
+	}
+	close(backend.release)
+	waitForRefreshes(t)
+
+	if backend.calls.Load() != 1 {
+		t.Errorf("backend called %d times, want one refresh", backend.calls.Load())
+	}
+	after := getStaleStats()
+	if after.RefreshesSkipped-before.RefreshesSkipped != 1 || after.Refreshes-before.Refreshes != 1 {
+		t.Errorf("stats went from %+v to %+v", before, after)
+	}
+}
+
+func TestStaleServedOnError(t *testing.T) {
+	tests := []struct {
+		status    int
+		wantStale bool
+	}{
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusGatewayTimeout, true},
+		{http.StatusNotFound, false},
+		{http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			config := testCacheConfig()
+			config.StaleIfError = 24 * time.Hour
+			handler := useCache(t, config, func(w http.ResponseWriter, r *http.Request) {
+				JSONError(w, errTestBackend, test.status)
+			})
+			putAged(t, config, coalescedTarget, `"old"`, 2*time.Hour, time.Hour)
+			before := getStaleStats()
+
+			rec := get(handler, coalescedTarget)
+			stale := rec.Header().Get("X-Cache") == "STALE"
+			if stale != test.wantStale {
+				t.Fatalf("got %d with X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+			}
+			if stale && (rec.Code != http.StatusOK || rec.Body.String() != `"old"`) {
+				t.Errorf("got %d %q, want the stale entry", rec.Code, rec.Body)
+			}
+			if !stale && rec.Code != test.status {
+				t.Errorf("status = %d, want %d", rec.Code, test.status)
+			}
+			if served := getStaleStats().ServedOnError - before.ServedOnError; (served == 1) != test.wantStale {
+				t.Errorf("served on error %d times", served)
+			}
+		})
+	}
+}
+
+func TestStaleIfErrorWindowEnds(t *testing.T) {
+	config := testCacheConfig()
+	config.StaleIfError = time.Hour
+	handler := useCache(t, config, func(w http.ResponseWriter, r *http.Request) {
+		JSONError(w, errTestBackend, http.StatusServiceUnavailable)
+	})
+	putAged(t, config, coalescedTarget, `"old"`, 3*time.Hour, time.Hour)
+
+	if rec := get(handler, coalescedTarget); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d with X-Cache %q, want the backend's 503", rec.Code, rec.Header().Get("X-Cache"))
+	}
+}
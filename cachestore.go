@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	backendBolt   = "bolt"
+	backendMemory = "memory"
+	backendRedis  = "redis"
+)
+
+// CacheStore is where cache entries are kept. Keys are storage keys and
+// values encoded CacheEntry values, already encrypted when the cache is.
+type CacheStore interface {
+	// Get returns the value stored under key, or nil if there is none
+	Get(key string) ([]byte, error)
+
+	// Set stores value under key. The store may drop it once ttl has
+	// passed; a zero ttl keeps it until it's deleted.
+	Set(key string, value []byte, ttl time.Duration) error
+
+	// Delete removes the given keys, ignoring any that aren't stored
+	Delete(keys ...string) error
+
+	// Scan calls fn with every stored key starting with prefix, and its
+	// value. fn must not modify the store.
+	Scan(prefix string, fn func(key string, value []byte) error) error
+
+	// KeyID returns the ID of the encryption key the entries were last
+	// checked against, empty for none, and whether one has been recorded.
+	// SetKeyID records it. It's kept apart from the entries.
+	KeyID() (string, bool, error)
+	SetKeyID(id string) error
+
+	Stats() (StoreStats, error)
+	Close() error
+}
+
+// StoreStats describes the backend a CacheStore keeps its entries in
+type StoreStats struct {
+	Backend string `json:"backend"`
+	Entries int    `json:"entries"`
+
+	// Size is the space the backend uses: the database file for bolt, the
+	// entries for memory and the whole server's memory for redis
+	Size int64 `json:"size_bytes"`
+}
+
+// hitRecorder is implemented by stores that track entry use for eviction
+type hitRecorder interface {
+	RecordHit(key string)
+}
+
+// sweeper is implemented by stores that don't drop expired entries by
+// themselves
+type sweeper interface {
+	sweep(batch int) (int, error)
+}
+
+// healthChecker is implemented by stores that can become unusable while the
+// process runs. The middleware bypasses a store that reports an error.
+type healthChecker interface {
+	healthy() error
+}
+
+// openCacheStore opens the backend selected by config.Backend
+func openCacheStore(config CacheConfig) (CacheStore, error) {
+	switch config.Backend {
+	case backendBolt:
+		return openBoltCache(config)
+	case backendMemory:
+		if config.MaxSize <= 0 {
+			return nil, fmt.Errorf("the memory cache needs a maximum size")
+		}
+		return newMemoryCache(config), nil
+	case backendRedis:
+		return openRedisCache(config)
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", config.Backend)
+	}
+}
+
+// entryStore encodes, encrypts and stores cache entries in a CacheStore
+type entryStore struct {
+	store  CacheStore
+	cipher *cacheCipher
+}
+
+// healthy reports why the underlying store can't be used, if it can't
+func (c *entryStore) healthy() error {
+	if checker, ok := c.store.(healthChecker); ok {
+		return checker.healthy()
+	}
+	return nil
+}
+
+func (c *entryStore) storageKey(key string, config CacheConfig) string {
+	if c.cipher == nil {
+		return key
+	}
+	return c.cipher.storageKey(key, config)
+}
+
+// get returns the decrypted entry for a request key, or nil if there is none.
+// Entries that can't be decrypted with the current key are never returned.
+func (c *entryStore) get(key string, config CacheConfig) (*CacheEntry, error) {
+	storageKey := c.storageKey(key, config)
+
+	data, err := c.store.Get(storageKey)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	entry := &CacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c.cipher != nil:
+		if _, err := c.cipher.open(entry, storageKey); err != nil {
+			return nil, err
+		}
+	case entry.Sealed != nil:
+		return nil, errWrongCacheKey
+	}
+	return entry, nil
+}
+
+// put stores an entry unless it's over the maximum entry size, reporting
+// whether it was stored
+func (c *entryStore) put(key string, entry CacheEntry, config CacheConfig) (bool, error) {
+	storageKey := c.storageKey(key, config)
+	if c.cipher != nil {
+		if err := c.cipher.seal(&entry, key, storageKey); err != nil {
+			return false, err
+		}
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return false, err
+	}
+	if config.MaxEntrySize > 0 && int64(len(storageKey)+len(data)) > config.MaxEntrySize {
+		evictionMu.Lock()
+		evictionStats.RejectedTooBig++
+		evictionMu.Unlock()
+		return false, nil
+	}
+
+	return true, c.store.Set(storageKey, data, entry.TTL+entry.Stale)
+}
+
+// recordHit tells the store an entry was used, if it keeps track
+func (c *entryStore) recordHit(key string, config CacheConfig) {
+	if recorder, ok := c.store.(hitRecorder); ok {
+		recorder.RecordHit(c.storageKey(key, config))
+	}
+}
+
+// purgeOldKeyVersions deletes entries whose keys don't start with the
+// current key version prefix
+func purgeOldKeyVersions(store CacheStore, config CacheConfig) (int, error) {
+	prefix := cacheKeyPrefix(config)
+	var stale []string
+	err := store.Scan("", func(key string, value []byte) error {
+		if !strings.HasPrefix(key, prefix) {
+			stale = append(stale, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(stale), store.Delete(stale...)
+}
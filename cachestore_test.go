@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStores opens an empty store of every backend
+func testStores() map[string]func(t *testing.T) CacheStore {
+	return map[string]func(t *testing.T) CacheStore{
+		backendBolt: func(t *testing.T) CacheStore {
+			store, err := openCacheStore(CacheConfig{Backend: backendBolt, DBPath: filepath.Join(t.TempDir(), "cache.db")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+		backendMemory: func(t *testing.T) CacheStore {
+			store, err := openCacheStore(CacheConfig{Backend: backendMemory, MaxSize: 1 << 20})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+		backendRedis: func(t *testing.T) CacheStore {
+			return openTestRedis(t, newFakeRedis(t, ""), CacheConfig{})
+		},
+	}
+}
+
+func TestCacheStoreConformance(t *testing.T) {
+	for backend, open := range testStores() {
+		t.Run(backend, func(t *testing.T) {
+			store := open(t)
+
+			if value, err := store.Get("v1:missing"); err != nil || value != nil {
+				t.Errorf("Get(missing) = %q, %v", value, err)
+			}
+
+			for key, value := range map[string]string{"v1:a": "1", "v1:b": "2", "v1:c/d": "3", "v2:a": "old"} {
+				if err := store.Set(key, []byte(value), time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.Set("v1:a", []byte("updated"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := store.Get("v1:a"); err != nil || string(value) != "updated" {
+				t.Errorf("Get = %q, %v, want the overwritten value", value, err)
+			}
+
+			if id, ok, err := store.KeyID(); err != nil || ok || id != "" {
+				t.Errorf("KeyID = %q, %v, %v, want none recorded", id, ok, err)
+			}
+			for _, id := range []string{"", "0123abcd"} {
+				if err := store.SetKeyID(id); err != nil {
+					t.Fatal(err)
+				}
+				if got, ok, err := store.KeyID(); err != nil || !ok || got != id {
+					t.Errorf("KeyID = %q, %v, %v, want %q", got, ok, err, id)
+				}
+			}
+
+			scanned := make(map[string]string)
+			err := store.Scan("v1:", func(key string, value []byte) error {
+				scanned[key] = string(value)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "map[v1:a:updated v1:b:2 v1:c/d:3]"; fmt.Sprint(scanned) != want {
+				t.Errorf("Scan(v1:) = %v, want %s", scanned, want)
+			}
+
+			all := 0
+			store.Scan("", func(key string, value []byte) error {
+				all++
+				return nil
+			})
+			stats, err := store.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if all != 4 || stats.Entries != 4 || stats.Backend != backend {
+				t.Errorf("scanned %d, stats %+v, want 4 entries without the key ID", all, stats)
+			}
+
+			if err := store.Delete("v1:a", "v2:a", "v1:missing"); err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range map[string]string{"v1:a": "", "v2:a": "", "v1:b": "2"} {
+				if value, err := store.Get(key); err != nil || string(value) != want {
+					t.Errorf("after Delete, Get(%s) = %q, %v, want %q", key, value, err, want)
+				}
+			}
+			if err := store.Delete(); err != nil {
+				t.Errorf("Delete() = %v", err)
+			}
+		})
+	}
+}
+
+// scanCounter counts full scans of a store
+type scanCounter struct {
+	CacheStore
+	scans int
+}
+
+func (s *scanCounter) Scan(prefix string, fn func(key string, value []byte) error) error {
+	s.scans++
+	return s.CacheStore.Scan(prefix, fn)
+}
+
+func testCipher(t *testing.T, seed byte) *cacheCipher {
+	t.Helper()
+	cipher, err := newCacheCipher(bytes.Repeat([]byte{seed}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cipher
+}
+
+func TestCheckCacheKeyRekeysOnce(t *testing.T) {
+	config := CacheConfig{KeyVersion: "1"}
+	entry := CacheEntry{StatusCode: 200, Body: []byte("secret"), Timestamp: time.Now(), TTL: time.Hour}
+	oldKey, newKey := testCipher(t, 1), testCipher(t, 2)
+
+	for backend, open := range testStores() {
+		t.Run(backend, func(t *testing.T) {
+			store := &scanCounter{CacheStore: open(t)}
+			if _, err := checkCacheKey(store, config, oldKey, nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := (&entryStore{store: store, cipher: oldKey}).put("v1:GET:/a", entry, config); err != nil {
+				t.Fatal(err)
+			}
+			// written unencrypted by a replica that hasn't been given a key
+			if _, err := (&entryStore{store: store}).put("v1:GET:/b", entry, config); err != nil {
+				t.Fatal(err)
+			}
+
+			store.scans = 0
+			if rewritten, err := checkCacheKey(store, config, oldKey, nil); err != nil || rewritten || store.scans != 0 {
+				t.Errorf("same key: rewritten %v, %d scans, %v, want the entries left alone", rewritten, store.scans, err)
+			}
+
+			rewritten, err := checkCacheKey(store, config, newKey, []*cacheCipher{oldKey})
+			if err != nil || !rewritten || store.scans != 1 {
+				t.Fatalf("rotated key: rewritten %v, %d scans, %v", rewritten, store.scans, err)
+			}
+			current := &entryStore{store: store, cipher: newKey}
+			if got, err := current.get("v1:GET:/a", config); err != nil || got == nil || string(got.Body) != "secret" {
+				t.Errorf("re-encrypted entry = %+v, %v", got, err)
+			}
+			if got, err := current.get("v1:GET:/b", config); err != nil || got != nil {
+				t.Errorf("unencrypted entry = %+v, %v, want it dropped", got, err)
+			}
+			if id, _, _ := store.KeyID(); id != newKey.id {
+				t.Errorf("recorded key ID = %q, want %q", id, newKey.id)
+			}
+
+			if rewritten, err := checkCacheKey(store, config, newKey, []*cacheCipher{oldKey}); err != nil || rewritten || store.scans != 1 {
+				t.Errorf("after rotation: rewritten %v, %d scans, %v, want no further scan", rewritten, store.scans, err)
+			}
+		})
+	}
+}
+
+func TestCheckCacheKeyDropsOldKeyVersions(t *testing.T) {
+	oldConfig, newConfig := CacheConfig{KeyVersion: "1"}, CacheConfig{KeyVersion: "2"}
+	entry := CacheEntry{StatusCode: 200, Body: []byte("secret"), Timestamp: time.Now(), TTL: time.Hour}
+	oldKey, newKey := testCipher(t, 1), testCipher(t, 2)
+
+	store := newMemoryCache(CacheConfig{MaxSize: 1 << 20})
+	if _, err := checkCacheKey(store, oldConfig, oldKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&entryStore{store: store, cipher: oldKey}).put("v1:GET:/a", entry, oldConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// the key and the key version change together
+	if _, err := checkCacheKey(store, newConfig, newKey, []*cacheCipher{oldKey}); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	store.Scan("", func(k string, v []byte) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if len(keys) != 0 {
+		t.Errorf("entries left after rotation: %q, want the old version dropped", keys)
+	}
+}
+
+func TestCheckCacheKeyLeavesUnencryptedCaches(t *testing.T) {
+	store := &scanCounter{CacheStore: newMemoryCache(CacheConfig{MaxSize: 1 << 20})}
+	store.Set("v1:GET:/a", []byte(`{"status_code":200}`), 0)
+
+	if rewritten, err := checkCacheKey(store, CacheConfig{}, nil, nil); err != nil || rewritten || store.scans != 0 {
+		t.Errorf("rewritten %v, %d scans, %v", rewritten, store.scans, err)
+	}
+	if value, _ := store.Get("v1:GET:/a"); value == nil {
+		t.Error("unencrypted entry was dropped")
+	}
+}
+
+func TestMemoryCacheRequiresMaxSize(t *testing.T) {
+	if _, err := openCacheStore(CacheConfig{Backend: backendMemory}); err == nil {
+		t.Error("opened an unbounded memory cache")
+	}
+
+	t.Setenv("CACHE_BACKEND", backendMemory)
+	t.Setenv("CACHE_MAX_SIZE", "")
+	if config := LoadCacheConfig(); config.MaxSize != defaultMemoryCacheSize {
+		t.Errorf("MaxSize = %d, want the %d default", config.MaxSize, defaultMemoryCacheSize)
+	}
+	t.Setenv("CACHE_MAX_SIZE", "1MB")
+	if config := LoadCacheConfig(); config.MaxSize != 1<<20 {
+		t.Errorf("MaxSize = %d, want CACHE_MAX_SIZE", config.MaxSize)
+	}
+}
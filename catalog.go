@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/audibleblink/passdb/hibp"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	catalogPath         = getEnv("BREACH_CATALOG_PATH", "./catalog.db")
+	catalogSyncInterval = getEnvDuration("BREACH_CATALOG_SYNC_INTERVAL", 24*time.Hour)
+
+	// catalog is nil when the catalog database couldn't be opened, in which
+	// case breach details are fetched from HIBP on every request
+	catalog *breachCatalog
+)
+
+const (
+	catalogBreachesBucket = "breaches"
+	catalogMetaBucket     = "meta"
+
+	catalogSyncedAtKey    = "synced_at"
+	catalogDataClassesKey = "dataclasses"
+)
+
+// breachCatalog is a local mirror of HIBP's breach metadata, so account
+// lookups can ask HIBP for breach names only and breach details stay
+// available when HIBP is down
+type breachCatalog struct {
+	db *bbolt.DB
+
+	// syncing serializes syncs from the schedule and the API
+	syncing sync.Mutex
+
+	// fetchingLogos is held while a sync's logos are downloaded
+	fetchingLogos sync.Mutex
+}
+
+// catalogStatus describes the state of the catalog for the API
+type catalogStatus struct {
+	Breaches int        `json:"breaches"`
+	SyncedAt *time.Time `json:"synced_at"`
+}
+
+func openBreachCatalog(path string) (*breachCatalog, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range []string{catalogBreachesBucket, catalogMetaBucket, catalogLogosBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &breachCatalog{db: db}, nil
+}
+
+// sync replaces the catalog with HIBP's current list of breaches and data
+// classes
+func (c *breachCatalog) sync(ctx context.Context, client *hibp.Client) (int, error) {
+	c.syncing.Lock()
+	defer c.syncing.Unlock()
+
+	breaches, err := client.AllBreaches(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	dataClasses, err := client.DataClasses(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(catalogBreachesBucket)); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket([]byte(catalogBreachesBucket))
+		if err != nil {
+			return err
+		}
+		for _, breach := range breaches {
+			data, err := json.Marshal(breach)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(catalogKey(breach.Name), data); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket([]byte(catalogMetaBucket))
+		data, err := json.Marshal(dataClasses)
+		if err != nil {
+			return err
+		}
+		if err := meta.Put([]byte(catalogDataClassesKey), data); err != nil {
+			return err
+		}
+		syncedAt := time.Now().UTC().Format(time.RFC3339)
+		return meta.Put([]byte(catalogSyncedAtKey), []byte(syncedAt))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// a sync requested over the API returns without waiting for the logos,
+	// and they're still fetched if its client goes away
+	c.fetchLogosInBackground(context.WithoutCancel(ctx), breaches)
+	return len(breaches), nil
+}
+
+// syncPeriodically keeps the catalog fresh, syncing straight away if the last
+// sync is older than interval
+func (c *breachCatalog) syncPeriodically(client *hibp.Client, interval time.Duration) {
+	for {
+		// on-demand syncs push the next scheduled one back
+		if status, err := c.status(); err == nil && status.SyncedAt != nil {
+			if wait := interval - time.Since(*status.SyncedAt); wait > 0 {
+				time.Sleep(wait)
+				continue
+			}
+		}
+
+		count, err := c.sync(context.Background(), client)
+		if err != nil {
+			log.Printf("Failed to sync breach catalog: %v", err)
+			// retry sooner than a full interval, but don't hammer HIBP
+			time.Sleep(min(interval, 15*time.Minute))
+			continue
+		}
+		log.Printf("Synced %d breaches into the breach catalog", count)
+	}
+}
+
+func (c *breachCatalog) status() (status catalogStatus, err error) {
+	err = c.db.View(func(tx *bbolt.Tx) error {
+		status.Breaches = tx.Bucket([]byte(catalogBreachesBucket)).Stats().KeyN
+		syncedAt := tx.Bucket([]byte(catalogMetaBucket)).Get([]byte(catalogSyncedAtKey))
+		if syncedAt == nil {
+			return nil
+		}
+		parsed, err := time.Parse(time.RFC3339, string(syncedAt))
+		if err != nil {
+			return err
+		}
+		status.SyncedAt = &parsed
+		return nil
+	})
+	return
+}
+
+// breach returns the catalog entry for name, or nil if there is none
+func (c *breachCatalog) breach(name string) (breach *hibp.BreachModel, err error) {
+	err = c.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(catalogBreachesBucket)).Get(catalogKey(name))
+		if data == nil {
+			return nil
+		}
+		breach = &hibp.BreachModel{}
+		return json.Unmarshal(data, breach)
+	})
+	return
+}
+
+// domainBreaches returns the catalog's breaches of the site at domain. ok is
+// false if the catalog hasn't been synced, so may be missing some.
+func (c *breachCatalog) domainBreaches(domain string) (breaches []hibp.BreachModel, ok bool, err error) {
+	err = c.db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte(catalogMetaBucket)).Get([]byte(catalogSyncedAtKey)) == nil {
+			return nil
+		}
+		ok = true
+		breaches = make([]hibp.BreachModel, 0)
+		return tx.Bucket([]byte(catalogBreachesBucket)).ForEach(func(_, data []byte) error {
+			var breach hibp.BreachModel
+			if err := json.Unmarshal(data, &breach); err != nil {
+				return err
+			}
+			if strings.EqualFold(breach.Domain, domain) {
+				breaches = append(breaches, breach)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// put adds or replaces a single breach, e.g. one added to HIBP since the last
+// sync
+func (c *breachCatalog) put(breach *hibp.BreachModel) error {
+	data, err := json.Marshal(breach)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(catalogBreachesBucket)).Put(catalogKey(breach.Name), data)
+	})
+}
+
+// putAll adds or replaces breaches in a single transaction
+func (c *breachCatalog) putAll(breaches []hibp.BreachModel) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(catalogBreachesBucket))
+		for _, breach := range breaches {
+			data, err := json.Marshal(breach)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(catalogKey(breach.Name), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// dataClasses returns the data classes from the last sync, or nil if the
+// catalog hasn't been synced
+func (c *breachCatalog) dataClasses() (dataClasses []string, err error) {
+	err = c.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(catalogMetaBucket)).Get([]byte(catalogDataClassesKey))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &dataClasses)
+	})
+	return
+}
+
+// catalogKey makes breach names case-insensitive, as they are in the HIBP API
+func catalogKey(name string) []byte {
+	return []byte(strings.ToLower(name))
+}
+
+// lookupBreach returns a breach's details from the catalog, falling back to
+// HIBP and remembering the answer
+func lookupBreach(ctx context.Context, name string) (*hibp.BreachModel, error) {
+	if catalog != nil {
+		breach, err := catalog.breach(name)
+		if err != nil {
+			log.Printf("Failed to read breach catalog: %v", err)
+		}
+		if breach != nil {
+			return breach, nil
+		}
+	}
+
+	breach, err := hibpClient.Breach(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if catalog != nil {
+		if err := catalog.put(breach); err != nil {
+			log.Printf("Failed to update breach catalog: %v", err)
+		}
+	}
+	return breach, nil
+}
+
+// domainBreaches returns the breaches of the site at domain from the catalog,
+// falling back to HIBP until the catalog has been synced
+func domainBreaches(ctx context.Context, domain string) ([]hibp.BreachModel, error) {
+	if catalog != nil {
+		breaches, ok, err := catalog.domainBreaches(domain)
+		if err != nil {
+			log.Printf("Failed to read breach catalog: %v", err)
+		}
+		if ok && err == nil {
+			return breaches, nil
+		}
+	}
+	return hibpClient.AllBreaches(ctx, domain)
+}
+
+// breachedAccount returns the breaches email appears in. With a catalog, HIBP
+// is only asked for breach names and the details are filled in locally. If
+// any breach is missing from the catalog, e.g. before its first sync, the
+// details are fetched in one untruncated call instead and added to it.
+func breachedAccount(ctx context.Context, email string) ([]hibp.BreachModel, error) {
+	if catalog == nil {
+		return untruncatedBreaches(ctx, email)
+	}
+
+	names, err := hibpClient.BreachedAccount(ctx, email, "", true, true)
+	if errors.Is(err, hibp.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	breaches := make([]hibp.BreachModel, 0, len(names))
+	for _, name := range names {
+		breach, err := catalog.breach(name.Name)
+		if err != nil {
+			log.Printf("Failed to read breach catalog: %v", err)
+		}
+		if breach == nil {
+			return untruncatedBreaches(ctx, email)
+		}
+		breaches = append(breaches, *breach)
+	}
+	return breaches, nil
+}
+
+// untruncatedBreaches asks HIBP for the full details of the breaches email
+// appears in, adding them to the catalog if there is one
+func untruncatedBreaches(ctx context.Context, email string) ([]hibp.BreachModel, error) {
+	breaches, err := hibpClient.BreachedAccount(ctx, email, "", false, true)
+	if errors.Is(err, hibp.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil || catalog == nil {
+		return breaches, err
+	}
+
+	if err := catalog.putAll(breaches); err != nil {
+		log.Printf("Failed to update breach catalog: %v", err)
+	}
+	return breaches, nil
+}
+
+// breachesByName returns the details of the named breaches keyed by their
+// lowercased names. They come from the catalog when it has every one, and
+// otherwise from a single call for all of HIBP's breaches, which are added
+// to it.
+func breachesByName(ctx context.Context, names []string) (map[string]*hibp.BreachModel, error) {
+	found := make(map[string]*hibp.BreachModel, len(names))
+	if catalog != nil {
+		for _, name := range names {
+			breach, err := catalog.breach(name)
+			if err != nil {
+				log.Printf("Failed to read breach catalog: %v", err)
+			}
+			if breach == nil {
+				break
+			}
+			found[string(catalogKey(name))] = breach
+		}
+		if len(found) == len(names) {
+			return found, nil
+		}
+	}
+
+	breaches, err := hibpClient.AllBreaches(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if catalog != nil {
+		if err := catalog.putAll(breaches); err != nil {
+			log.Printf("Failed to update breach catalog: %v", err)
+		}
+	}
+	for i := range breaches {
+		found[string(catalogKey(breaches[i].Name))] = &breaches[i]
+	}
+	return found, nil
+}
+
+func handleCatalogStatus(w http.ResponseWriter, r *http.Request) {
+	if catalog == nil {
+		JSONError(w, fmt.Errorf("breach catalog is not available"), http.StatusServiceUnavailable)
+		return
+	}
+
+	status, err := catalog.status()
+	if err != nil {
+		JSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+	jsonWriter(w, status)
+}
+
+func handleCatalogSync(w http.ResponseWriter, r *http.Request) {
+	if catalog == nil {
+		JSONError(w, fmt.Errorf("breach catalog is not available"), http.StatusServiceUnavailable)
+		return
+	}
+
+	if _, err := catalog.sync(r.Context(), hibpClient); err != nil {
+		hibpError(w, err)
+		return
+	}
+	handleCatalogStatus(w, r)
+}
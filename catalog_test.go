@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/audibleblink/passdb/hibp"
+)
+
+// useHIBP points hibpClient at a stand-in API served by handler for the
+// duration of the test
+func useHIBP(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	previous := hibpClient
+	hibpClient = hibp.NewClient(hibp.Config{APIKey: "test-key", BaseURL: server.URL})
+	t.Cleanup(func() {
+		server.Close()
+		hibpClient = previous
+	})
+}
+
+// useCatalog opens an empty breach catalog for the duration of the test
+func useCatalog(t *testing.T) {
+	t.Helper()
+	opened, err := openBreachCatalog(filepath.Join(t.TempDir(), "catalog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := catalog
+	catalog = opened
+	t.Cleanup(func() {
+		opened.db.Close()
+		catalog = previous
+	})
+}
+
+func TestBreachedAccountFillsEmptyCatalog(t *testing.T) {
+	var calls, truncated atomic.Int32
+	useHIBP(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Query().Get("truncateResponse") != "false" {
+			truncated.Add(1)
+			w.Write([]byte(`[{"Name":"Adobe"},{"Name":"Dropbox"}]`))
+			return
+		}
+		w.Write([]byte(`[{"Name":"Adobe","Title":"Adobe"},{"Name":"Dropbox","Title":"Dropbox"}]`))
+	})
+	useCatalog(t)
+
+	breaches, err := breachedAccount(context.Background(), "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(breaches) != 2 || breaches[1].Title != "Dropbox" {
+		t.Fatalf("got %+v", breaches)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("empty catalog: %d HIBP calls, want the truncated call and one untruncated call", calls.Load())
+	}
+
+	// the untruncated call filled the catalog, so names are enough now
+	if _, err := breachedAccount(context.Background(), "test@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 3 || truncated.Load() != 2 {
+		t.Errorf("filled catalog: %d more HIBP calls, want a single truncated call", calls.Load()-2)
+	}
+}
+
+func TestDomainBreachesFromSyncedCatalog(t *testing.T) {
+	var calls atomic.Int32
+	var down atomic.Bool
+	useHIBP(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch {
+		case r.URL.Path == "/dataclasses":
+			w.Write([]byte(`["Passwords"]`))
+		case r.URL.Query().Get("domain") == "adobe.com":
+			w.Write([]byte(`[{"Name":"Adobe","Domain":"adobe.com"}]`))
+		default:
+			w.Write([]byte(`[
+				{"Name":"Adobe","Domain":"adobe.com"},
+				{"Name":"AdobeForums","Domain":"Adobe.com"},
+				{"Name":"Dropbox","Domain":"dropbox.com"}
+			]`))
+		}
+	})
+	useCatalog(t)
+
+	// before the first sync, the catalog may be missing breaches
+	breaches, err := domainBreaches(context.Background(), "adobe.com")
+	if err != nil || len(breaches) != 1 || calls.Load() != 1 {
+		t.Fatalf("unsynced: got %+v, %v after %d HIBP calls, want HIBP's answer", breaches, err, calls.Load())
+	}
+
+	if _, err := catalog.sync(context.Background(), hibpClient); err != nil {
+		t.Fatal(err)
+	}
+	down.Store(true)
+	calls.Store(0)
+
+	breaches, err = domainBreaches(context.Background(), "ADOBE.com")
+	if err != nil || len(breaches) != 2 || breaches[0].Name != "Adobe" || breaches[1].Name != "AdobeForums" {
+		t.Errorf("synced: got %+v, %v, want both adobe.com breaches", breaches, err)
+	}
+	if breaches, err := domainBreaches(context.Background(), "example.com"); err != nil || breaches == nil || len(breaches) != 0 {
+		t.Errorf("unknown domain: got %#v, %v, want an empty list", breaches, err)
+	}
+	if calls.Load() != 0 {
+		t.Errorf("%d HIBP calls, want the synced catalog to answer while HIBP is down", calls.Load())
+	}
+}
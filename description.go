@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Formats breach descriptions can be rendered in. HIBP descriptions are HTML
+// fragments with links, returned untouched as descriptionRaw by default.
+const (
+	descriptionRaw       = "html"
+	descriptionSanitized = "sanitized"
+	descriptionText      = "text"
+	descriptionMarkdown  = "markdown"
+)
+
+// allowedTags are the elements kept by the sanitizer; everything else is
+// dropped, keeping its text
+var allowedTags = map[string]bool{
+	"a": true, "b": true, "strong": true, "i": true, "em": true, "u": true,
+	"p": true, "br": true, "ul": true, "ol": true, "li": true,
+	"code": true, "blockquote": true,
+}
+
+// droppedTags are removed along with their contents
+var droppedTags = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true, "embed": true,
+	"template": true, "noscript": true,
+}
+
+var (
+	collapseSpaces   = regexp.MustCompile(`[ \t\r\n\f]+`)
+	spaceAroundLines = regexp.MustCompile(` *\n *`)
+	extraNewlines    = regexp.MustCompile(`\n{3,}`)
+)
+
+// parseDescriptionFormat reads the ?description= query parameter
+func parseDescriptionFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("description"); format {
+	case "":
+		return descriptionRaw, nil
+	case descriptionRaw, descriptionSanitized, descriptionText, descriptionMarkdown:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid description format %q: use html, sanitized, text or markdown", format)
+	}
+}
+
+// renderDescription converts an HIBP breach description to format
+func renderDescription(description, format string) string {
+	if format == descriptionRaw || description == "" {
+		return description
+	}
+
+	renderer := &descriptionRenderer{format: format}
+	tokenizer := html.NewTokenizer(strings.NewReader(description))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			if tokenizer.Err() != io.EOF {
+				// the tokenizer only fails on read errors, which a string
+				// reader doesn't return
+				return ""
+			}
+			break
+		}
+		renderer.token(tokenizer.Token())
+	}
+	return renderer.finish()
+}
+
+// descriptionRenderer walks the tokens of a description, writing the sanitized
+// HTML, plain-text or markdown rendering of it
+type descriptionRenderer struct {
+	format string
+	out    bytes.Buffer
+
+	// open holds the allowed elements that haven't been closed yet
+	open []string
+
+	// links holds the href and output offset of each open anchor, so text and
+	// markdown renderings can wrap the link text once it's complete
+	links []link
+
+	// dropping counts the open elements whose contents are being removed
+	dropping int
+}
+
+type link struct {
+	href  string
+	start int
+}
+
+func (d *descriptionRenderer) token(token html.Token) {
+	name := token.Data
+	switch token.Type {
+	case html.TextToken:
+		if d.dropping == 0 {
+			d.text(token.Data)
+		}
+
+	case html.StartTagToken, html.SelfClosingTagToken:
+		if droppedTags[name] {
+			if token.Type == html.StartTagToken {
+				d.dropping++
+			}
+			return
+		}
+		if d.dropping > 0 || !allowedTags[name] {
+			return
+		}
+		d.start(name, token)
+		if token.Type == html.StartTagToken && name != "br" {
+			d.open = append(d.open, name)
+		}
+
+	case html.EndTagToken:
+		if droppedTags[name] {
+			if d.dropping > 0 {
+				d.dropping--
+			}
+			return
+		}
+		if d.dropping > 0 || !allowedTags[name] {
+			return
+		}
+		// close everything opened inside the element as well, so the
+		// sanitized output is always balanced
+		for i := len(d.open) - 1; i >= 0; i-- {
+			if d.open[i] == name {
+				for len(d.open) > i {
+					d.end(d.open[len(d.open)-1])
+					d.open = d.open[:len(d.open)-1]
+				}
+				break
+			}
+		}
+	}
+}
+
+func (d *descriptionRenderer) text(text string) {
+	if d.format == descriptionSanitized {
+		d.out.WriteString(html.EscapeString(text))
+		return
+	}
+	text = collapseSpaces.ReplaceAllString(text, " ")
+	if d.format == descriptionMarkdown {
+		text = escapeMarkdown(text)
+	}
+	d.out.WriteString(text)
+}
+
+func (d *descriptionRenderer) start(name string, token html.Token) {
+	if d.format == descriptionSanitized {
+		d.out.WriteString("<" + name)
+		if name == "a" {
+			if href := safeHref(token); href != "" {
+				d.out.WriteString(` href="` + html.EscapeString(href) + `"`)
+			}
+			d.out.WriteString(` rel="noopener noreferrer"`)
+		}
+		d.out.WriteString(">")
+		return
+	}
+
+	switch name {
+	case "a":
+		d.links = append(d.links, link{href: safeHref(token), start: d.out.Len()})
+	case "br":
+		d.out.WriteString("\n")
+	case "p", "ul", "ol", "blockquote":
+		d.out.WriteString("\n\n")
+	case "li":
+		d.out.WriteString("\n")
+		if d.format == descriptionMarkdown {
+			d.out.WriteString("- ")
+		}
+	}
+	if d.format == descriptionMarkdown {
+		switch name {
+		case "b", "strong":
+			d.out.WriteString("**")
+		case "i", "em":
+			d.out.WriteString("_")
+		case "code":
+			d.out.WriteString("`")
+		case "blockquote":
+			d.out.WriteString("> ")
+		}
+	}
+}
+
+func (d *descriptionRenderer) end(name string) {
+	if d.format == descriptionSanitized {
+		d.out.WriteString("</" + name + ">")
+		return
+	}
+
+	switch name {
+	case "a":
+		d.endLink()
+	case "p", "ul", "ol", "blockquote":
+		d.out.WriteString("\n\n")
+	}
+	if d.format == descriptionMarkdown {
+		switch name {
+		case "b", "strong":
+			d.out.WriteString("**")
+		case "i", "em":
+			d.out.WriteString("_")
+		case "code":
+			d.out.WriteString("`")
+		}
+	}
+}
+
+// endLink rewrites the text of the innermost open link as "text (href)" or
+// "[text](href)"
+func (d *descriptionRenderer) endLink() {
+	if len(d.links) == 0 {
+		return
+	}
+	current := d.links[len(d.links)-1]
+	d.links = d.links[:len(d.links)-1]
+	if current.href == "" {
+		return
+	}
+
+	text := strings.TrimSpace(d.out.String()[current.start:])
+	d.out.Truncate(current.start)
+	switch {
+	case d.format == descriptionMarkdown:
+		d.out.WriteString("[" + text + "](" + markdownHrefEscaper.Replace(current.href) + ")")
+	case text == "" || text == current.href:
+		d.out.WriteString(current.href)
+	default:
+		d.out.WriteString(text + " (" + current.href + ")")
+	}
+}
+
+// finish closes any elements left open and tidies up whitespace
+func (d *descriptionRenderer) finish() string {
+	for len(d.open) > 0 {
+		d.end(d.open[len(d.open)-1])
+		d.open = d.open[:len(d.open)-1]
+	}
+	if d.format == descriptionSanitized {
+		return d.out.String()
+	}
+
+	text := spaceAroundLines.ReplaceAllString(d.out.String(), "\n")
+	text = extraNewlines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
+
+// safeHref returns the anchor's href if it's an http, https or mailto URL, so
+// javascript: and data: links never reach clients
+func safeHref(token html.Token) string {
+	for _, attr := range token.Attr {
+		if attr.Key != "href" {
+			continue
+		}
+		u, err := url.Parse(strings.TrimSpace(attr.Val))
+		if err != nil {
+			return ""
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "http", "https", "mailto":
+			return u.String()
+		}
+		return ""
+	}
+	return ""
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`,
+)
+
+// markdownHrefEscaper percent-encodes the characters that would end a
+// markdown link's destination early
+var markdownHrefEscaper = strings.NewReplacer(
+	"(", "%28", ")", "%29", " ", "%20", "<", "%3C", ">", "%3E",
+)
+
+func escapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
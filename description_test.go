@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestSafeHref(t *testing.T) {
+	tests := []struct {
+		href, want string
+	}{
+		{"https://example.com/a?b=c", "https://example.com/a?b=c"},
+		{"HTTP://example.com", "http://example.com"},
+		{"  https://example.com  ", "https://example.com"},
+		{"mailto:abuse@example.com", "mailto:abuse@example.com"},
+		{"javascript:alert(1)", ""},
+		{"JaVaScRiPt:alert(1)", ""},
+		{" \tjavascript:alert(1)", ""},
+		{"java\tscript:alert(1)", ""},
+		{"data:text/html;base64,PHNjcmlwdD4=", ""},
+		{"vbscript:msgbox", ""},
+		{"//example.com", ""},
+		{"/relative", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		token := html.Token{Type: html.StartTagToken, Data: "a", Attr: []html.Attribute{{Key: "href", Val: test.href}}}
+		if got := safeHref(token); got != test.want {
+			t.Errorf("safeHref(%q) = %q, want %q", test.href, got, test.want)
+		}
+	}
+	if got := safeHref(html.Token{Type: html.StartTagToken, Data: "a"}); got != "" {
+		t.Errorf("safeHref without href = %q", got)
+	}
+}
+
+func TestRenderDescription(t *testing.T) {
+	tests := []struct {
+		name, description, format, want string
+	}{
+		{
+			"raw is untouched", `<a href="javascript:x()">x</a>`, descriptionRaw,
+			`<a href="javascript:x()">x</a>`,
+		},
+		{
+			"link", `In 2013, <a href="https://example.com/news" target="_blank">Adobe</a> was breached.`, descriptionSanitized,
+			`In 2013, <a href="https://example.com/news" rel="noopener noreferrer">Adobe</a> was breached.`,
+		},
+		{
+			"javascript link", `<a href="JavaScript:alert(1)" onclick="x()">click</a>`, descriptionSanitized,
+			`<a rel="noopener noreferrer">click</a>`,
+		},
+		{
+			"data link", `<a href=" data:text/html,<script>x</script>">click</a>`, descriptionSanitized,
+			`<a rel="noopener noreferrer">click</a>`,
+		},
+		{
+			"script and style", `a<script>alert("<b>")</script>b<style>p{}</style>c<noscript><p>d</p></noscript>`, descriptionSanitized,
+			`abc`,
+		},
+		{
+			"disallowed tags keep their text", `<div class="x"><span>text</span><img src=x onerror=y></div>`, descriptionSanitized,
+			`text`,
+		},
+		{
+			"attribute escaping", `<a href="https://example.com/?a=1&amp;b=&quot;2&quot;">x</a>`, descriptionSanitized,
+			`<a href="https://example.com/?a=1&amp;b=&#34;2&#34;" rel="noopener noreferrer">x</a>`,
+		},
+		{
+			"text escaping", `1 &lt; 2 &amp; <b>3 > 2</b>`, descriptionSanitized,
+			`1 &lt; 2 &amp; <b>3 &gt; 2</b>`,
+		},
+		{
+			"unclosed elements", `<p><b>bold <a href="https://example.com">link`, descriptionSanitized,
+			`<p><b>bold <a href="https://example.com" rel="noopener noreferrer">link</a></b></p>`,
+		},
+		{
+			"stray closing tags", `</a></p>text</b>`, descriptionSanitized,
+			`text`,
+		},
+		{
+			"closing an outer element closes inner ones", `<p><a href="https://example.com"><b>x</p>y`, descriptionSanitized,
+			`<p><a href="https://example.com" rel="noopener noreferrer"><b>x</b></a></p>y`,
+		},
+		{
+			"nested links", `<a href="https://a.example">a <a href="https://b.example">b</a> c</a>`, descriptionText,
+			`a b (https://b.example) c (https://a.example)`,
+		},
+		{
+			"text", `<p>See <a href="https://example.com">the notice</a>.</p><ul><li>one</li><li>two</li></ul>`, descriptionText,
+			"See the notice (https://example.com).\n\none\ntwo",
+		},
+		{
+			"text link to itself", `<a href="https://example.com">https://example.com</a>`, descriptionText,
+			`https://example.com`,
+		},
+		{
+			"text unsafe link", `<a href="javascript:x()">click</a> here`, descriptionText,
+			`click here`,
+		},
+		{
+			"markdown", `<p><b>Passwords</b> were <em>hashed</em> with <code>md5</code>. See <a href="https://example.com">this</a>.</p>`, descriptionMarkdown,
+			"**Passwords** were _hashed_ with `md5`. See [this](https://example.com).",
+		},
+		{
+			"markdown escaping", `2*3 [not a link](x) _a_ \`, descriptionMarkdown,
+			`2\*3 \[not a link\](x) \_a\_ \\`,
+		},
+		{
+			"markdown href with parentheses and spaces", `<a href="https://example.com/a_(b)?q=c d">x</a>`, descriptionMarkdown,
+			`[x](https://example.com/a_%28b%29?q=c%20d)`,
+		},
+		{
+			"markdown href smuggling a link", `<a href="https://example.com/) [evil](https://evil.example">x</a>`, descriptionMarkdown,
+			`[x](https://example.com/%29%20%5Bevil%5D%28https://evil.example)`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := renderDescription(test.description, test.format); got != test.want {
+				t.Errorf("got  %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRenderDescriptionDropsScriptAcrossFormats(t *testing.T) {
+	description := `<p>Hello</p><script>document.cookie</script><style>body{}</style>`
+	for _, format := range []string{descriptionSanitized, descriptionText, descriptionMarkdown} {
+		got := renderDescription(description, format)
+		if strings.Contains(got, "cookie") || strings.Contains(got, "body") || !strings.Contains(got, "Hello") {
+			t.Errorf("%s: %q", format, got)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/audibleblink/passdb/hibp"
+	"github.com/go-chi/chi"
+)
+
+// domainBreachesRoute is where domain searches are served. Their responses
+// aren't cached whole, so local record counts stay current; the route's TTL
+// applies to the HIBP domain search responses they're built from instead.
+const domainBreachesRoute = "/api/v1/domains/*/breaches"
+
+// domainSearch is every breached alias on a domain, grouped by breach
+type domainSearch struct {
+	Domain   string              `json:"domain"`
+	Aliases  int                 `json:"aliases"`
+	Breaches []*domainBreachHits `json:"breaches"`
+}
+
+// domainBreachHits are the aliases on a domain found in one breach
+type domainBreachHits struct {
+	Name       string         `json:"name"`
+	Title      string         `json:"title,omitempty"`
+	BreachDate string         `json:"breach_date,omitempty"`
+	Aliases    []*domainAlias `json:"aliases"`
+}
+
+// domainAlias is a breached address and how many local records it has
+type domainAlias struct {
+	Alias        string `json:"alias"`
+	Email        string `json:"email"`
+	LocalRecords int64  `json:"local_records"`
+}
+
+// handleDomainSearch returns the breached aliases of a domain verified for
+// the HIBP API key, grouped by breach, with their local record counts
+func handleDomainSearch(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+
+	ttl := cacheConfig.RouteTTLs[domainBreachesRoute]
+	aliases, err := cachedUpstream("hibp/breacheddomain/"+domain, ttl, func() (map[string][]string, error) {
+		aliases, err := hibpClient.BreachedDomain(r.Context(), domain)
+		if errors.Is(err, hibp.ErrNotFound) {
+			return map[string][]string{}, nil
+		}
+		return aliases, err
+	})
+	if err != nil {
+		hibpError(w, err)
+		return
+	}
+
+	names := make([]string, 0, len(aliases))
+	for alias := range aliases {
+		names = append(names, alias)
+	}
+	counts, err := localRecordCounts(r.Context(), domain, names)
+	if err != nil {
+		JSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonWriter(w, groupByBreach(r.Context(), domain, aliases, counts))
+}
+
+// groupByBreach inverts HIBP's alias to breach names mapping, filling in
+// breach titles and dates from the catalog
+func groupByBreach(ctx context.Context, domain string, aliases map[string][]string, counts map[string]int64) *domainSearch {
+	search := &domainSearch{Domain: domain, Aliases: len(aliases), Breaches: []*domainBreachHits{}}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, breachNames := range aliases {
+		for _, name := range breachNames {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	details, err := breachesByName(ctx, names)
+	if err != nil {
+		log.Printf("Failed to look up breaches: %v", err)
+	}
+
+	byName := make(map[string]*domainBreachHits)
+	for alias, breachNames := range aliases {
+		for _, name := range breachNames {
+			hits, ok := byName[name]
+			if !ok {
+				hits = &domainBreachHits{Name: name}
+				if breach := details[string(catalogKey(name))]; breach != nil {
+					hits.Title, hits.BreachDate = breach.Title, breach.BreachDate
+				}
+				byName[name] = hits
+				search.Breaches = append(search.Breaches, hits)
+			}
+			hits.Aliases = append(hits.Aliases, &domainAlias{
+				Alias:        alias,
+				Email:        alias + "@" + domain,
+				LocalRecords: counts[alias],
+			})
+		}
+	}
+
+	// most widely affecting breaches first
+	sort.Slice(search.Breaches, func(i, j int) bool {
+		a, b := search.Breaches[i], search.Breaches[j]
+		if len(a.Aliases) != len(b.Aliases) {
+			return len(a.Aliases) > len(b.Aliases)
+		}
+		return a.Name < b.Name
+	})
+	for _, hits := range search.Breaches {
+		sort.Slice(hits.Aliases, func(i, j int) bool {
+			return hits.Aliases[i].Alias < hits.Aliases[j].Alias
+		})
+	}
+	return search
+}
+
+// localRecordCounts counts the records for each of the given usernames on
+// domain
+func localRecordCounts(ctx context.Context, domain string, usernames []string) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	if len(usernames) == 0 {
+		return counts, nil
+	}
+
+	query := bq.Query(fmt.Sprintf(
+		`SELECT username, COUNT(*) AS records FROM %s
+		WHERE domain = @domain AND username IN UNNEST(@usernames)
+		GROUP BY username`,
+		bigQueryTable,
+	))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "domain", Value: domain},
+		{Name: "usernames", Value: usernames},
+	}
+
+	var row struct {
+		Username bigquery.NullString `bigquery:"username"`
+		Records  int64               `bigquery:"records"`
+	}
+	err := readRows(ctx, query, &row, func() {
+		counts[row.Username.StringVal] = row.Records
+	})
+	return counts, err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupByBreachFetchesBreachesOnce(t *testing.T) {
+	var calls atomic.Int32
+	useHIBP(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path != "/breaches" {
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[
+			{"Name":"Adobe","Title":"Adobe","BreachDate":"2013-10-04"},
+			{"Name":"Dropbox","Title":"Dropbox","BreachDate":"2012-07-01"},
+			{"Name":"LinkedIn","Title":"LinkedIn","BreachDate":"2012-05-05"}
+		]`))
+	})
+	useCatalog(t)
+	aliases := map[string][]string{
+		"alice": {"Adobe", "Dropbox"},
+		"bob":   {"Adobe", "LinkedIn"},
+		"carol": {"Adobe"},
+	}
+
+	for range 2 {
+		search := groupByBreach(context.Background(), "acme.com", aliases, map[string]int64{"alice": 3})
+
+		if search.Aliases != 3 || len(search.Breaches) != 3 {
+			t.Fatalf("got %+v", search)
+		}
+		adobe := search.Breaches[0]
+		if adobe.Name != "Adobe" || adobe.Title != "Adobe" || adobe.BreachDate != "2013-10-04" || len(adobe.Aliases) != 3 {
+			t.Errorf("first breach = %+v, want Adobe with all three aliases", adobe)
+		}
+		if alias := adobe.Aliases[0]; alias.Email != "alice@acme.com" || alias.LocalRecords != 3 {
+			t.Errorf("first alias = %+v", alias)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("%d HIBP calls, want one for the empty catalog and none once it's filled", calls.Load())
+	}
+}
+
+func TestDomainSearchesAreNotCachedWhole(t *testing.T) {
+	config := testCacheConfig()
+	config.RouteTTLs = map[string]time.Duration{
+		"/api/v1/domains/":  time.Hour,
+		domainBreachesRoute: time.Hour,
+	}
+	calls := 0
+	handler := useCache(t, config, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{}`))
+	})
+
+	for range 2 {
+		get(handler, "/api/v1/domains/acme.com/breaches")
+	}
+	if calls != 2 {
+		t.Errorf("backend called %d times, want every domain search to reach it", calls)
+	}
+	get(handler, "/api/v1/domains/acme.com")
+	if rec := get(handler, "/api/v1/domains/acme.com"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("X-Cache = %q, want other domain routes still cached", rec.Header().Get("X-Cache"))
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/go-chi/chi v4.1.2+incompatible
 	github.com/go-chi/cors v1.1.1
 	go.etcd.io/bbolt v1.4.1
+	golang.org/x/net v0.0.0-20200813134508-3edf25e44fcc
 	google.golang.org/api v0.29.0
 )
 
@@ -21,7 +22,6 @@ require (
 	go.opencensus.io v0.22.3 // indirect
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b // indirect
 	golang.org/x/mod v0.3.0 // indirect
-	golang.org/x/net v0.0.0-20200813134508-3edf25e44fcc // indirect
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
 	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/text v0.3.2 // indirect
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const hashTypePlaintext = "plaintext"
+
+// hashFormat describes a password hash format recognizable from its shape
+// alone. Patterns use RE2 syntax so the same expressions can classify values
+// in Go and in BigQuery Standard SQL.
+type hashFormat struct {
+	Name    string
+	Pattern string
+}
+
+// hashFormats is checked in order; the first match wins. Bare hex digests
+// are ambiguous (an NTLM hash looks like an MD5), so they are named after the
+// most common algorithm of that length.
+var hashFormats = []hashFormat{
+	{"bcrypt", `^\$2[abxy]?\$\d{2}\$[./A-Za-z0-9]{53}$`},
+	{"phpass", `^\$[PH]\$[./A-Za-z0-9]{31}$`},
+	{"md5crypt", `^\$1\$[^$]{0,8}\$[./A-Za-z0-9]{22}$`},
+	{"sha256crypt", `^\$5\$(rounds=\d+\$)?[^$]{0,16}\$[./A-Za-z0-9]{43}$`},
+	{"sha512crypt", `^\$6\$(rounds=\d+\$)?[^$]{0,16}\$[./A-Za-z0-9]{86}$`},
+	{"argon2", `^\$argon2(id|i|d)\$`},
+	{"mysql5", `^\*[0-9A-Fa-f]{40}$`},
+	{"md5", `^[0-9A-Fa-f]{32}$`},
+	{"sha1", `^[0-9A-Fa-f]{40}$`},
+	{"sha256", `^[0-9A-Fa-f]{64}$`},
+	{"sha512", `^[0-9A-Fa-f]{128}$`},
+}
+
+var hashPatterns = func() []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, len(hashFormats))
+	for i, format := range hashFormats {
+		patterns[i] = regexp.MustCompile(format.Pattern)
+	}
+	return patterns
+}()
+
+// classifyPassword returns the name of the hash format value appears to be
+// in, or "plaintext". Empty values are left unclassified.
+func classifyPassword(value string) string {
+	if value == "" {
+		return ""
+	}
+	for i, pattern := range hashPatterns {
+		if pattern.MatchString(value) {
+			return hashFormats[i].Name
+		}
+	}
+	return hashTypePlaintext
+}
+
+// hashTypeSQL returns a BigQuery expression that classifies column the same
+// way classifyPassword does
+func hashTypeSQL(column string) string {
+	var sql strings.Builder
+	sql.WriteString("CASE")
+	for _, format := range hashFormats {
+		fmt.Fprintf(&sql, " WHEN REGEXP_CONTAINS(%s, r'%s') THEN '%s'", column, format.Pattern, format.Name)
+	}
+	fmt.Fprintf(&sql, " WHEN %s IS NULL OR %s = '' THEN NULL ELSE '%s' END", column, column, hashTypePlaintext)
+	return sql.String()
+}
+
+// filterRecords applies the ?hashed= and ?hash_type= query filters
+func filterRecords(records []*record, hashed *bool, hashTypes map[string]bool) []*record {
+	if hashed == nil && len(hashTypes) == 0 {
+		return records
+	}
+
+	filtered := make([]*record, 0, len(records))
+	for _, rec := range records {
+		isHashed := rec.HashType != "" && rec.HashType != hashTypePlaintext
+		if hashed != nil && isHashed != *hashed {
+			continue
+		}
+		if len(hashTypes) > 0 && !hashTypes[rec.HashType] {
+			continue
+		}
+		filtered = append(filtered, rec)
+	}
+	return filtered
+}
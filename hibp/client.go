@@ -0,0 +1,336 @@
+package hibp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API URL of haveibeenpwned.com
+const API = "https://haveibeenpwned.com/api/v3/"
+
+// DefaultUserAgent is sent when Config.UserAgent is empty. HIBP rejects
+// requests without a user agent.
+const DefaultUserAgent = "passdb"
+
+// DefaultTimeout bounds each API call when Config.Timeout is zero
+const DefaultTimeout = 30 * time.Second
+
+// DefaultMaxWait bounds how long a call queues for its turn under the rate
+// limit when Config.MaxWait is zero
+const DefaultMaxWait = 30 * time.Second
+
+// maxAttempts is how many times a call is sent when HIBP keeps answering 429
+const maxAttempts = 3
+
+var (
+	// ErrNotFound is returned when the API has no results, e.g. for an
+	// account that isn't in any breach
+	ErrNotFound = errors.New("hibp: not found")
+
+	// ErrBadRequest is returned when the account doesn't comply with an
+	// acceptable format
+	ErrBadRequest = errors.New("hibp: the account does not comply with an acceptable format")
+
+	// ErrUnauthorized is returned when the API key is missing or invalid
+	ErrUnauthorized = errors.New("hibp: valid header `hibp-api-key` required")
+
+	// ErrForbidden is returned when the API key may not make the request,
+	// e.g. a domain search for a domain that isn't verified for the key
+	ErrForbidden = errors.New("hibp: forbidden")
+
+	// ErrRateLimited matches any *RateLimitError with errors.Is
+	ErrRateLimited = errors.New("hibp: rate limit exceeded")
+)
+
+// RateLimitError is returned when the API keeps responding with 429 Too Many
+// Requests, or when a call would queue longer than Config.MaxWait
+type RateLimitError struct {
+	// RetryAfter is how long the caller should wait before trying again
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrRateLimited, e.RetryAfter)
+}
+
+// Is reports whether target is ErrRateLimited
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// Config configures a Client. Either APIKey or Keys is required.
+type Config struct {
+	APIKey    string
+	BaseURL   string
+	UserAgent string
+
+	// PwnedPasswordsURL is the base URL of the Pwned Passwords API, which
+	// needs no API key and isn't rate limited
+	PwnedPasswordsURL string
+
+	// Timeout bounds each call. It's applied to a copy of HTTPClient, if
+	// set, whose own Timeout is otherwise respected.
+	Timeout    time.Duration
+	HTTPClient *http.Client
+
+	// RequestsPerMinute is the rate limit of the API key's subscription,
+	// enforced locally so requests queue instead of failing with 429s. Zero
+	// disables the local limit. Burst is how many requests may be sent back
+	// to back after a quiet period, one by default.
+	RequestsPerMinute int
+	Burst             int
+
+	// Keys is a pool of API keys, each with its own rate limit, that calls
+	// are spread across. When set, APIKey, RequestsPerMinute and Burst are
+	// ignored.
+	Keys []Key
+
+	// A key that gets QuarantineAfter 401s in a row is taken out of
+	// rotation for QuarantineFor
+	QuarantineAfter int
+	QuarantineFor   time.Duration
+
+	// MaxWait is the longest a call waits for its turn before failing with
+	// a *RateLimitError
+	MaxWait time.Duration
+}
+
+// Client calls the haveibeenpwned.com API
+type Client struct {
+	baseURL      string
+	passwordsURL string
+	userAgent    string
+	http         *http.Client
+	maxWait      time.Duration
+
+	// mu orders key selection so calls get their turn in arrival order
+	mu              sync.Mutex
+	keys            []*apiKey
+	quarantineAfter int
+	quarantineFor   time.Duration
+}
+
+// NewClient returns a Client for config, filling in defaults for any zero
+// values
+func NewClient(config Config) *Client {
+	client := &Client{
+		baseURL:         config.BaseURL,
+		passwordsURL:    config.PwnedPasswordsURL,
+		userAgent:       config.UserAgent,
+		maxWait:         config.MaxWait,
+		quarantineAfter: config.QuarantineAfter,
+		quarantineFor:   config.QuarantineFor,
+	}
+
+	keys := config.Keys
+	if len(keys) == 0 {
+		keys = []Key{{
+			APIKey:            config.APIKey,
+			RequestsPerMinute: config.RequestsPerMinute,
+			Burst:             config.Burst,
+		}}
+	}
+	for _, key := range keys {
+		client.keys = append(client.keys, newAPIKey(key))
+	}
+
+	if client.baseURL == "" {
+		client.baseURL = API
+	}
+	if client.passwordsURL == "" {
+		client.passwordsURL = PwnedPasswordsAPI
+	}
+	if client.userAgent == "" {
+		client.userAgent = DefaultUserAgent
+	}
+	if client.maxWait == 0 {
+		client.maxWait = DefaultMaxWait
+	}
+	if client.quarantineAfter == 0 {
+		client.quarantineAfter = DefaultQuarantineAfter
+	}
+	if client.quarantineFor == 0 {
+		client.quarantineFor = DefaultQuarantineFor
+	}
+
+	httpClient := &http.Client{}
+	if config.HTTPClient != nil {
+		copied := *config.HTTPClient
+		httpClient = &copied
+	}
+	if config.Timeout > 0 {
+		httpClient.Timeout = config.Timeout
+	} else if httpClient.Timeout == 0 {
+		httpClient.Timeout = DefaultTimeout
+	}
+	client.http = httpClient
+
+	return client
+}
+
+// Stats reports the client's queue depth and throttling counters summed
+// across its keys
+func (c *Client) Stats() Stats {
+	var total Stats
+	for _, key := range c.keys {
+		stats := key.limiter.stats()
+		total.QueueDepth += stats.QueueDepth
+		total.Requests += stats.Requests
+		total.Throttled += stats.Throttled
+		total.Rejected += stats.Rejected
+		total.RateLimited += stats.RateLimited
+	}
+	return total
+}
+
+// KeyStats reports the usage and health of each key in the client's pool
+func (c *Client) KeyStats() []KeyStats {
+	now := time.Now()
+	stats := make([]KeyStats, len(c.keys))
+	for i, key := range c.keys {
+		stats[i] = key.stats(now)
+	}
+	return stats
+}
+
+// acquire picks the key that can send soonest, skipping quarantined keys and
+// those in rejected, and waits for its turn
+func (c *Client) acquire(ctx context.Context, rejected map[*apiKey]bool) (*apiKey, error) {
+	c.mu.Lock()
+	now := time.Now()
+	var best *apiKey
+	var bestDelay time.Duration
+	for _, key := range c.keys {
+		if key.quarantined(now) || rejected[key] {
+			continue
+		}
+		if delay := key.limiter.next(); best == nil || delay < bestDelay {
+			best, bestDelay = key, delay
+		}
+	}
+	if best == nil {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%w: every API key is quarantined or was rejected", ErrUnauthorized)
+	}
+	delay, ok := best.limiter.reserve(c.maxWait)
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, &RateLimitError{RetryAfter: delay}
+	}
+	return best, best.limiter.sleep(ctx, delay)
+}
+
+// get calls service and decodes the JSON response into v
+func (c *Client) get(ctx context.Context, service string, parameters url.Values, v interface{}) error {
+	res, err := c.callService(ctx, service, parameters)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// callService waits for a turn under the rate limit and calls service,
+// retrying after the requested pause when HIBP answers 429 and with another
+// key when one is rejected
+func (c *Client) callService(
+	ctx context.Context,
+	service string,
+	parameters url.Values,
+) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.baseURL, "/") + "/" + service)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = parameters.Encode()
+
+	// keys that answered 401 aren't retried within the call
+	rejected := make(map[*apiKey]bool)
+	for attempt := 1; ; attempt++ {
+		key, err := c.acquire(ctx, rejected)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := c.do(ctx, u, key.APIKey)
+		var rateLimited *RateLimitError
+		switch {
+		case errors.As(err, &rateLimited):
+			key.limiter.pause(rateLimited.RetryAfter)
+			if rateLimited.RetryAfter > c.maxWait && len(c.keys) == 1 {
+				return nil, err
+			}
+		case errors.Is(err, ErrUnauthorized):
+			key.failed(c.quarantineAfter, c.quarantineFor)
+			rejected[key] = true
+			if len(rejected) == len(c.keys) {
+				return nil, err
+			}
+		default:
+			key.succeeded()
+			return res, err
+		}
+
+		if attempt == maxAttempts {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, u *url.URL, apiKey string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set("hibp-api-key", apiKey)
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusOK {
+		return res, nil
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	case http.StatusBadRequest:
+		return nil, ErrBadRequest
+	case http.StatusUnauthorized:
+		return nil, ErrUnauthorized
+	case http.StatusForbidden:
+		return nil, ErrForbidden
+	case http.StatusTooManyRequests:
+		return nil, &RateLimitError{RetryAfter: retryAfter(res.Header.Get("retry-after"))}
+	}
+	return nil, fmt.Errorf("hibp: unexpected response %s", res.Status)
+}
+
+// retryAfter parses a retry-after header given in seconds, as HIBP sends
+// it, waiting at least a second when it's missing
+func retryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || seconds < 1 {
+		return time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,98 @@
+package hibp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestErrorsByStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   error
+	}{
+		{http.StatusBadRequest, ErrBadRequest},
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusTooManyRequests, ErrRateLimited},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("retry-after", "120")
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+			client := NewClient(Config{APIKey: "test-key", BaseURL: server.URL, MaxWait: time.Second})
+
+			_, err := client.BreachedAccount(context.Background(), "test@example.com", "", true, false)
+			if !errors.Is(err, test.want) {
+				t.Errorf("err = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestUnexpectedStatus(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	_, err := client.DataClasses(context.Background())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, typed := range []error{ErrNotFound, ErrBadRequest, ErrUnauthorized, ErrForbidden, ErrRateLimited} {
+		if errors.Is(err, typed) {
+			t.Errorf("err = %v, shouldn't match %v", err, typed)
+		}
+	}
+}
+
+func TestAccountsArePathEscaped(t *testing.T) {
+	var path, query string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		path, query = r.URL.EscapedPath(), r.URL.RawQuery
+		w.Write([]byte(`[]`))
+	})
+
+	_, err := client.BreachedAccount(context.Background(), "a/b c?d@example.com", "", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/breachedaccount/a%2Fb%20c%3Fd@example.com"; path != want {
+		t.Errorf("path = %q, want %q", path, want)
+	}
+	if query != "" {
+		t.Errorf("query = %q, want the account kept out of the query", query)
+	}
+}
+
+func TestBreachedAccountParameters(t *testing.T) {
+	var query map[string][]string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(`[{"Name":"Adobe"}]`))
+	})
+
+	breaches, err := client.BreachedAccount(context.Background(), "test@example.com", "adobe.com", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(breaches) != 1 || breaches[0].Name != "Adobe" {
+		t.Errorf("got %+v", breaches)
+	}
+	for key, want := range map[string]string{
+		"domain":            "adobe.com",
+		"truncateResponse":  "false",
+		"includeUnverified": "true",
+	} {
+		if got := query[key]; len(got) != 1 || got[0] != want {
+			t.Errorf("%s = %v, want %s", key, got, want)
+		}
+	}
+}
@@ -2,17 +2,10 @@
 package hibp
 
 import (
-	"encoding/json"
-	"errors"
-	"io"
-	"net/http"
+	"context"
 	"net/url"
-	"os"
 )
 
-// API URL of haveibeenpwned.com
-const API = "https://haveibeenpwned.com/api/v3/"
-
 // BreachModel Each breach contains a number of attributes describing the incident. In the future, these attributes may expand without the API being versioned.
 type BreachModel struct {
 	Name         string   `json:"Name,omitempty"`
@@ -32,77 +25,112 @@ type BreachModel struct {
 	LogoPath     string   `json:"LogoPath,omitempty"`
 }
 
-// BreachedAccount The most common use of the API is to return a list of all breaches a particular account has been involved in. The API takes a single parameter which is the account to be searched for. The account is not case sensitive and will be trimmed of leading or trailing white spaces. The account should always be URL encoded.
-func BreachedAccount(
+// PasteModel Each paste contains a number of attributes describing it. In the future, these attributes may expand without the API being versioned.
+type PasteModel struct {
+	Source     string `json:"Source,omitempty"`
+	ID         string `json:"Id,omitempty"`
+	Title      string `json:"Title,omitempty"`
+	Date       string `json:"Date,omitempty"`
+	EmailCount int    `json:"EmailCount,omitempty"`
+}
+
+// SubscriptionStatusModel describes the subscription tied to the API key in use.
+type SubscriptionStatusModel struct {
+	SubscriptionName                string `json:"SubscriptionName,omitempty"`
+	Description                     string `json:"Description,omitempty"`
+	SubscribedUntil                 string `json:"SubscribedUntil,omitempty"`
+	Rpm                             int    `json:"Rpm,omitempty"`
+	DomainSearchMaxBreachedAccounts int    `json:"DomainSearchMaxBreachedAccounts,omitempty"`
+}
+
+// BreachedAccount The most common use of the API is to return a list of all breaches a particular account has been involved in. The API takes a single parameter which is the account to be searched for. The account is not case sensitive and will be trimmed of leading or trailing white spaces. The account should always be URL encoded. Returns ErrNotFound if the account isn't in any breach.
+func (c *Client) BreachedAccount(
+	ctx context.Context,
 	account, domainFilter string,
 	truncate, unverified bool,
 ) ([]BreachModel, error) {
-	res, err := callService("breachedaccount", account, domainFilter, truncate, unverified)
-	if err != nil {
-		return nil, err
+	parameters := url.Values{}
+	if domainFilter != "" {
+		parameters.Add("domain", domainFilter)
 	}
-	if res.StatusCode == http.StatusNotFound {
-		return nil, nil
+	if !truncate {
+		parameters.Add("truncateResponse", "false")
 	}
-
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+	if unverified {
+		parameters.Add("includeUnverified", "true")
 	}
-	defer res.Body.Close()
 
 	breaches := make([]BreachModel, 0)
-	if err := json.Unmarshal(body, &breaches); err != nil {
+	if err := c.get(ctx, "breachedaccount/"+url.PathEscape(account), parameters, &breaches); err != nil {
 		return nil, err
 	}
-
 	return breaches, nil
 }
 
-func callService(
-	service, account, domainFilter string,
-	truncate, unverified bool,
-) (*http.Response, error) {
-	client := &http.Client{}
-
-	u, err := url.Parse(API)
-	if err != nil {
-		return nil, err
-	}
-
-	u.Path += service + "/" + account
+// AllBreaches A "breach" is an instance of a system having been compromised by an attacker and the data disclosed. This returns the details of each breach in the system, optionally filtered to breaches against the given domain.
+func (c *Client) AllBreaches(ctx context.Context, domainFilter string) ([]BreachModel, error) {
 	parameters := url.Values{}
 	if domainFilter != "" {
 		parameters.Add("domain", domainFilter)
 	}
-	if !truncate {
-		parameters.Add("truncateResponse", "false")
+
+	breaches := make([]BreachModel, 0)
+	if err := c.get(ctx, "breaches", parameters, &breaches); err != nil {
+		return nil, err
 	}
-	if unverified {
-		parameters.Add("includeUnverified", "true")
+	return breaches, nil
+}
+
+// Breach Sometimes just a single breach is required and this can be retrieved by the breach "name". This is the stable value which may or may not be the same as the breach "title" (which can change). Returns ErrNotFound if no breach has that name.
+func (c *Client) Breach(ctx context.Context, name string) (*BreachModel, error) {
+	breach := &BreachModel{}
+	if err := c.get(ctx, "breach/"+url.PathEscape(name), nil, breach); err != nil {
+		return nil, err
 	}
-	u.RawQuery = parameters.Encode()
+	return breach, nil
+}
 
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
+// LatestBreach Returns the most recently added breach based on the "AddedDate" attribute of the breach model.
+func (c *Client) LatestBreach(ctx context.Context) (*BreachModel, error) {
+	breach := &BreachModel{}
+	if err := c.get(ctx, "latestbreach", nil, breach); err != nil {
 		return nil, err
 	}
+	return breach, nil
+}
+
+// DataClasses A "data class" is an attribute of a record compromised in a breach. For example, many breaches expose data classes such as "Email addresses" and "Passwords". This returns an alphabetically ordered list of all of them.
+func (c *Client) DataClasses(ctx context.Context) ([]string, error) {
+	dataClasses := make([]string, 0)
+	if err := c.get(ctx, "dataclasses", nil, &dataClasses); err != nil {
+		return nil, err
+	}
+	return dataClasses, nil
+}
 
-	req.Header.Set("User-Agent", "Go/1.15")
-	req.Header.Set("hibp-api-key", os.Getenv("HIBP_API_KEY"))
-	res, err := client.Do(req)
+// BreachedDomain Returns all email addresses on a domain that have been breached, mapping each alias (the part before the @) to the names of the breaches it appears in. The domain must have been verified in the HIBP dashboard of the account the API key belongs to. Returns ErrNotFound if no aliases on the domain have been breached.
+func (c *Client) BreachedDomain(ctx context.Context, domain string) (map[string][]string, error) {
+	aliases := make(map[string][]string)
+	if err := c.get(ctx, "breacheddomain/"+url.PathEscape(domain), nil, &aliases); err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
 
-	switch res.StatusCode {
-	case http.StatusBadRequest:
-		return nil, errors.New("the account does not comply with an acceptable format")
-	case http.StatusTooManyRequests:
-		return nil, errors.New("too many requests — the rate limit has been exceeded")
-	case http.StatusUnauthorized:
-		return nil, errors.New("valid header `hibp-api-key` required")
+// PasteAccount The API takes a single parameter which is the email address to be searched for. Unlike searching for breaches, usernames that are not email addresses cannot be searched for. The email is not case sensitive and will be trimmed of leading or trailing white spaces. Returns ErrNotFound if the email isn't in any paste.
+func (c *Client) PasteAccount(ctx context.Context, account string) ([]PasteModel, error) {
+	pastes := make([]PasteModel, 0)
+	if err := c.get(ctx, "pasteaccount/"+url.PathEscape(account), nil, &pastes); err != nil {
+		return nil, err
 	}
+	return pastes, nil
+}
 
-	if err != nil {
+// SubscriptionStatus Returns details of the current subscription, including the rate limit of the API key.
+func (c *Client) SubscriptionStatus(ctx context.Context) (*SubscriptionStatusModel, error) {
+	status := &SubscriptionStatusModel{}
+	if err := c.get(ctx, "subscription/status", nil, status); err != nil {
 		return nil, err
 	}
-	return res, nil
+	return status, nil
 }
@@ -0,0 +1,171 @@
+package hibp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client for a stand-in API served by handler
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return NewClient(Config{APIKey: "test-key", BaseURL: server.URL})
+}
+
+// serveJSON answers requests for path with body, and 404 for any other path
+func serveJSON(t *testing.T, path, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("hibp-api-key") != "test-key" {
+			t.Errorf("hibp-api-key = %q", r.Header.Get("hibp-api-key"))
+		}
+		if r.Header.Get("User-Agent") != DefaultUserAgent {
+			t.Errorf("User-Agent = %q", r.Header.Get("User-Agent"))
+		}
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}
+}
+
+func TestAllBreaches(t *testing.T) {
+	var domain string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		domain = r.URL.Query().Get("domain")
+		serveJSON(t, "/breaches", `[{"Name":"Adobe","PwnCount":152445165},{"Name":"Dropbox"}]`)(w, r)
+	})
+
+	breaches, err := client.AllBreaches(context.Background(), "adobe.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain != "adobe.com" {
+		t.Errorf("domain filter = %q, want adobe.com", domain)
+	}
+	want := []BreachModel{{Name: "Adobe", PwnCount: 152445165}, {Name: "Dropbox"}}
+	if !reflect.DeepEqual(breaches, want) {
+		t.Errorf("got %+v, want %+v", breaches, want)
+	}
+}
+
+func TestBreach(t *testing.T) {
+	client := newTestClient(t, serveJSON(t, "/breach/Adobe", `{"Name":"Adobe","Title":"Adobe","DataClasses":["Email addresses","Passwords"]}`))
+
+	breach, err := client.Breach(context.Background(), "Adobe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if breach.Title != "Adobe" || len(breach.DataClasses) != 2 {
+		t.Errorf("got %+v", breach)
+	}
+
+	if _, err := client.Breach(context.Background(), "Missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing breach: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLatestBreach(t *testing.T) {
+	client := newTestClient(t, serveJSON(t, "/latestbreach", `{"Name":"Newest","AddedDate":"2024-01-02T03:04:05Z"}`))
+
+	breach, err := client.LatestBreach(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if breach.Name != "Newest" || breach.AddedDate != "2024-01-02T03:04:05Z" {
+		t.Errorf("got %+v", breach)
+	}
+}
+
+func TestDataClasses(t *testing.T) {
+	client := newTestClient(t, serveJSON(t, "/dataclasses", `["Email addresses","Passwords","Usernames"]`))
+
+	dataClasses, err := client.DataClasses(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Email addresses", "Passwords", "Usernames"}
+	if !reflect.DeepEqual(dataClasses, want) {
+		t.Errorf("got %v, want %v", dataClasses, want)
+	}
+}
+
+func TestPasteAccount(t *testing.T) {
+	client := newTestClient(t, serveJSON(t, "/pasteaccount/test@example.com", `[{"Source":"Pastebin","Id":"8Q0BvKD8","EmailCount":139}]`))
+
+	pastes, err := client.PasteAccount(context.Background(), "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PasteModel{{Source: "Pastebin", ID: "8Q0BvKD8", EmailCount: 139}}
+	if !reflect.DeepEqual(pastes, want) {
+		t.Errorf("got %+v, want %+v", pastes, want)
+	}
+
+	if _, err := client.PasteAccount(context.Background(), "clean@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("account without pastes: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSubscriptionStatus(t *testing.T) {
+	client := newTestClient(t, serveJSON(t, "/subscription/status", `{"SubscriptionName":"Pwned 1","Rpm":10,"DomainSearchMaxBreachedAccounts":25}`))
+
+	status, err := client.SubscriptionStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &SubscriptionStatusModel{SubscriptionName: "Pwned 1", Rpm: 10, DomainSearchMaxBreachedAccounts: 25}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("got %+v, want %+v", status, want)
+	}
+}
+
+func TestRetriesAfterRateLimit(t *testing.T) {
+	calls := 0
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("retry-after", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		serveJSON(t, "/dataclasses", `["Passwords"]`)(w, r)
+	})
+
+	start := time.Now()
+	dataClasses, err := client.DataClasses(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || len(dataClasses) != 1 {
+		t.Errorf("calls = %d, data classes = %v", calls, dataClasses)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("retried after %s, want at least the 1s retry-after", waited)
+	}
+}
+
+func TestRateLimitedBeyondMaxWait(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("retry-after", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	client := NewClient(Config{APIKey: "test-key", BaseURL: server.URL, MaxWait: time.Second})
+
+	_, err := client.LatestBreach(context.Background())
+	var rateLimited *RateLimitError
+	if !errors.As(err, &rateLimited) || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("err = %v, want a *RateLimitError", err)
+	}
+	if rateLimited.RetryAfter != time.Minute {
+		t.Errorf("RetryAfter = %s, want 1m", rateLimited.RetryAfter)
+	}
+}
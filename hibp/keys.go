@@ -0,0 +1,109 @@
+package hibp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultQuarantineAfter is how many 401s in a row take a key out of rotation
+// when Config.QuarantineAfter is zero
+const DefaultQuarantineAfter = 3
+
+// DefaultQuarantineFor is how long a key stays out of rotation when
+// Config.QuarantineFor is zero
+const DefaultQuarantineFor = time.Hour
+
+// Key is one HIBP API key in a Client's pool
+type Key struct {
+	APIKey string
+
+	// RequestsPerMinute is the rate limit of the key's subscription; zero
+	// disables the local limit. Burst is how many requests may be sent back
+	// to back after a quiet period, one by default.
+	RequestsPerMinute int
+	Burst             int
+}
+
+// apiKey tracks the rate limit and health of a Key
+type apiKey struct {
+	Key
+	limiter *limiter
+
+	mu               sync.Mutex
+	failures         int
+	unauthorized     uint64
+	quarantinedUntil time.Time
+}
+
+func newAPIKey(key Key) *apiKey {
+	return &apiKey{
+		Key:     key,
+		limiter: newLimiter(key.RequestsPerMinute, key.Burst),
+	}
+}
+
+func (k *apiKey) quarantined(now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return now.Before(k.quarantinedUntil)
+}
+
+// failed records a 401 and quarantines the key once it has failed after
+// times in a row
+func (k *apiKey) failed(after int, quarantine time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.unauthorized++
+	k.failures++
+	if k.failures >= after {
+		k.quarantinedUntil = time.Now().Add(quarantine)
+		k.failures = 0
+	}
+}
+
+// succeeded resets the run of 401s
+func (k *apiKey) succeeded() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.failures = 0
+}
+
+// KeyStats reports the usage and health of one key in a Client's pool
+type KeyStats struct {
+	// Key is the API key with all but its last four characters masked
+	Key               string `json:"key"`
+	RequestsPerMinute int    `json:"requests_per_minute"`
+	Stats
+
+	// Unauthorized is the number of 401 responses received for the key
+	Unauthorized     uint64     `json:"unauthorized"`
+	Quarantined      bool       `json:"quarantined"`
+	QuarantinedUntil *time.Time `json:"quarantined_until,omitempty"`
+}
+
+func (k *apiKey) stats(now time.Time) KeyStats {
+	stats := KeyStats{
+		Key:               maskKey(k.APIKey),
+		RequestsPerMinute: k.RequestsPerMinute,
+		Stats:             k.limiter.stats(),
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	stats.Unauthorized = k.unauthorized
+	if now.Before(k.quarantinedUntil) {
+		until := k.quarantinedUntil
+		stats.Quarantined = true
+		stats.QuarantinedUntil = &until
+	}
+	return stats
+}
+
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return fmt.Sprintf("****%s", key[len(key)-4:])
+}
@@ -0,0 +1,184 @@
+package hibp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keyServer is a stand-in API that records the key each request was sent
+// with and answers with the status set for that key, 200 by default
+type keyServer struct {
+	mu       sync.Mutex
+	used     []string
+	statuses map[string]int
+}
+
+func (s *keyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("hibp-api-key")
+	s.mu.Lock()
+	s.used = append(s.used, key)
+	status := s.statuses[key]
+	s.mu.Unlock()
+
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("retry-after", "60")
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	w.Write([]byte(`[]`))
+}
+
+// calls returns the keys used since the last call
+func (s *keyServer) calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used := s.used
+	s.used = nil
+	return used
+}
+
+func newKeyClient(t *testing.T, server *keyServer, config Config) *Client {
+	t.Helper()
+	stub := httptest.NewServer(server)
+	t.Cleanup(stub.Close)
+	config.BaseURL = stub.URL
+	return NewClient(config)
+}
+
+func callWith(t *testing.T, client *Client, server *keyServer, want ...string) {
+	t.Helper()
+	_, err := client.AllBreaches(context.Background(), "")
+	used := server.calls()
+	if err != nil {
+		t.Errorf("call = %v with keys %v", err, used)
+		return
+	}
+	if len(used) != len(want) {
+		t.Errorf("sent with keys %v, want %v", used, want)
+		return
+	}
+	for i := range used {
+		if used[i] != want[i] {
+			t.Errorf("sent with keys %v, want %v", used, want)
+			return
+		}
+	}
+}
+
+func TestKeysRotateWithTheirRateLimits(t *testing.T) {
+	server := &keyServer{}
+	client := newKeyClient(t, server, Config{Keys: []Key{
+		{APIKey: "key-aaaa", RequestsPerMinute: 60},
+		{APIKey: "key-bbbb", RequestsPerMinute: 60},
+	}})
+
+	callWith(t, client, server, "key-aaaa")
+	// key-aaaa has to wait for its next token, key-bbbb doesn't
+	callWith(t, client, server, "key-bbbb")
+
+	stats := client.KeyStats()
+	if stats[0].Key != "****aaaa" || stats[0].Requests != 1 || stats[1].Requests != 1 {
+		t.Errorf("key stats = %+v", stats)
+	}
+}
+
+func TestRateLimitedKeyIsPaused(t *testing.T) {
+	server := &keyServer{statuses: map[string]int{"key-aaaa": http.StatusTooManyRequests}}
+	client := newKeyClient(t, server, Config{Keys: []Key{{APIKey: "key-aaaa"}, {APIKey: "key-bbbb"}}})
+
+	callWith(t, client, server, "key-aaaa", "key-bbbb")
+	// key-aaaa is held back for its retry-after, but isn't quarantined
+	callWith(t, client, server, "key-bbbb")
+
+	stats := client.KeyStats()
+	if stats[0].RateLimited != 1 || stats[0].Quarantined || stats[0].Unauthorized != 0 {
+		t.Errorf("key-aaaa stats = %+v", stats[0])
+	}
+}
+
+func TestUnauthorizedKeyIsQuarantined(t *testing.T) {
+	server := &keyServer{statuses: map[string]int{"key-aaaa": http.StatusUnauthorized}}
+	client := newKeyClient(t, server, Config{
+		Keys:            []Key{{APIKey: "key-aaaa"}, {APIKey: "key-bbbb"}},
+		QuarantineAfter: 2,
+		QuarantineFor:   200 * time.Millisecond,
+	})
+
+	// key-aaaa is tried first while it's in rotation
+	callWith(t, client, server, "key-aaaa", "key-bbbb")
+	if stats := client.KeyStats()[0]; stats.Quarantined || stats.Unauthorized != 1 {
+		t.Errorf("after one 401, key-aaaa stats = %+v", stats)
+	}
+	callWith(t, client, server, "key-aaaa", "key-bbbb")
+
+	stats := client.KeyStats()[0]
+	if !stats.Quarantined || stats.QuarantinedUntil == nil || stats.Unauthorized != 2 {
+		t.Fatalf("after two 401s, key-aaaa stats = %+v", stats)
+	}
+	callWith(t, client, server, "key-bbbb")
+
+	// released once the quarantine ends
+	time.Sleep(time.Until(*stats.QuarantinedUntil) + 10*time.Millisecond)
+	if stats := client.KeyStats()[0]; stats.Quarantined || stats.QuarantinedUntil != nil {
+		t.Errorf("after the quarantine, key-aaaa stats = %+v", stats)
+	}
+	callWith(t, client, server, "key-aaaa", "key-bbbb")
+}
+
+func TestSuccessResetsUnauthorizedRun(t *testing.T) {
+	server := &keyServer{statuses: map[string]int{"key-aaaa": http.StatusUnauthorized}}
+	client := newKeyClient(t, server, Config{
+		Keys:            []Key{{APIKey: "key-aaaa"}, {APIKey: "key-bbbb"}},
+		QuarantineAfter: 2,
+	})
+
+	callWith(t, client, server, "key-aaaa", "key-bbbb")
+	server.mu.Lock()
+	delete(server.statuses, "key-aaaa")
+	server.mu.Unlock()
+	callWith(t, client, server, "key-aaaa")
+	server.mu.Lock()
+	server.statuses["key-aaaa"] = http.StatusUnauthorized
+	server.mu.Unlock()
+	callWith(t, client, server, "key-aaaa", "key-bbbb")
+
+	if stats := client.KeyStats()[0]; stats.Quarantined || stats.Unauthorized != 2 {
+		t.Errorf("key-aaaa stats = %+v, want 401s that weren't in a row left in rotation", stats)
+	}
+}
+
+func TestEveryKeyQuarantined(t *testing.T) {
+	server := &keyServer{statuses: map[string]int{"key-aaaa": http.StatusUnauthorized, "key-bbbb": http.StatusUnauthorized}}
+	client := newKeyClient(t, server, Config{
+		Keys:            []Key{{APIKey: "key-aaaa"}, {APIKey: "key-bbbb"}},
+		QuarantineAfter: 1,
+	})
+
+	if _, err := client.AllBreaches(context.Background(), ""); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("call = %v, want ErrUnauthorized", err)
+	}
+	if used := server.calls(); len(used) != 2 {
+		t.Errorf("sent with keys %v, want each tried once", used)
+	}
+	if _, err := client.AllBreaches(context.Background(), ""); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("call = %v, want ErrUnauthorized", err)
+	}
+	if used := server.calls(); len(used) != 0 {
+		t.Errorf("sent with quarantined keys %v", used)
+	}
+}
+
+func TestMaskKey(t *testing.T) {
+	for key, want := range map[string]string{"": "****", "abcd": "****", "0123456789abcdef": "****cdef"} {
+		if got := maskKey(key); got != want {
+			t.Errorf("maskKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package hibp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket that hands out tokens in the order they're asked
+// for, so callers are served first come, first served
+type limiter struct {
+	mu sync.Mutex
+
+	// interval is the time it takes to earn one token; zero disables the
+	// local limit, leaving only pauses from 429 responses
+	interval time.Duration
+	burst    float64
+	tokens   float64
+	last     time.Time
+
+	// pausedUntil holds every caller back after HIBP sends a retry-after
+	pausedUntil time.Time
+
+	waiting     int
+	requests    uint64
+	throttled   uint64
+	rejected    uint64
+	rateLimited uint64
+}
+
+func newLimiter(requestsPerMinute, burst int) *limiter {
+	l := &limiter{burst: float64(burst), last: time.Now()}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	if requestsPerMinute > 0 {
+		l.interval = time.Minute / time.Duration(requestsPerMinute)
+	}
+	l.tokens = l.burst
+	return l
+}
+
+// refill adds the tokens earned since the last call; the caller must hold l.mu
+func (l *limiter) refill(now time.Time) {
+	if l.interval > 0 {
+		earned := float64(now.Sub(l.last)) / float64(l.interval)
+		l.tokens = min(l.burst, l.tokens+earned)
+	}
+	l.last = now
+}
+
+// delayFor returns how long a caller would wait if it took a token now with
+// tokens left in the bucket; the caller must hold l.mu
+func (l *limiter) delayFor(now time.Time, tokens float64) (delay time.Duration) {
+	if l.interval > 0 && tokens < 0 {
+		delay = time.Duration(-tokens * float64(l.interval))
+	}
+	if pause := l.pausedUntil.Sub(now); pause > delay {
+		delay = pause
+	}
+	return delay
+}
+
+// next returns how long a caller taking a token now would have to wait
+func (l *limiter) next() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.refill(now)
+	return l.delayFor(now, l.tokens-1)
+}
+
+// reserve takes a token and returns how long the caller has to wait before
+// using it. If that's longer than maxWait the token is handed back and ok is
+// false.
+func (l *limiter) reserve(maxWait time.Duration) (delay time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.refill(now)
+	if l.interval > 0 {
+		l.tokens--
+	}
+	delay = l.delayFor(now, l.tokens)
+
+	if maxWait > 0 && delay > maxWait {
+		l.cancel()
+		l.rejected++
+		return delay, false
+	}
+
+	l.requests++
+	if delay > 0 {
+		l.throttled++
+	}
+	return delay, true
+}
+
+// cancel hands back a reserved token; the caller must hold l.mu
+func (l *limiter) cancel() {
+	if l.interval > 0 {
+		l.tokens++
+	}
+}
+
+// sleep blocks for the delay returned by reserve, handing the token back if
+// ctx is done first
+func (l *limiter) sleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	l.waiting++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.cancel()
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// pause holds back every caller for retryAfter after a 429
+func (l *limiter) pause(retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rateLimited++
+	if until := time.Now().Add(retryAfter); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	// start refilling from empty once the pause ends
+	if l.interval > 0 && l.tokens > 0 {
+		l.tokens = 0
+	}
+}
+
+func (l *limiter) stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return Stats{
+		QueueDepth:  l.waiting,
+		Requests:    l.requests,
+		Throttled:   l.throttled,
+		Rejected:    l.rejected,
+		RateLimited: l.rateLimited,
+	}
+}
+
+// Stats reports how a Client's requests have been scheduled
+type Stats struct {
+	// QueueDepth is the number of calls currently waiting for their turn
+	QueueDepth int `json:"queue_depth"`
+
+	// Requests is the number of calls sent to the API
+	Requests uint64 `json:"requests"`
+
+	// Throttled is the number of calls that had to wait for the local rate
+	// limit or a retry-after pause
+	Throttled uint64 `json:"throttled"`
+
+	// Rejected is the number of calls that failed because they would have
+	// waited longer than Config.MaxWait
+	Rejected uint64 `json:"rejected"`
+
+	// RateLimited is the number of 429 responses received from the API
+	RateLimited uint64 `json:"rate_limited"`
+}
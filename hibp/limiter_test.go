@@ -0,0 +1,162 @@
+package hibp
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// rewind moves the limiter's clock back by d, as if d had passed
+func (l *limiter) rewind(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last = l.last.Add(-d)
+}
+
+func near(got, want time.Duration) bool {
+	return got > want-100*time.Millisecond && got <= want
+}
+
+func TestLimiterBurst(t *testing.T) {
+	l := newLimiter(60, 3)
+	for i := range 3 {
+		if delay, ok := l.reserve(time.Minute); !ok || delay != 0 {
+			t.Fatalf("request %d waited %s, want the burst sent at once", i+1, delay)
+		}
+	}
+	if delay, ok := l.reserve(time.Minute); !ok || !near(delay, time.Second) {
+		t.Errorf("request after the burst waits %s, want about a second", delay)
+	}
+	if delay, _ := l.reserve(time.Minute); !near(delay, 2*time.Second) {
+		t.Errorf("next request waits %s, want about two seconds", delay)
+	}
+	if stats := l.stats(); stats.Requests != 5 || stats.Throttled != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestLimiterRefill(t *testing.T) {
+	l := newLimiter(60, 3)
+	for range 3 {
+		l.reserve(time.Minute)
+	}
+
+	l.rewind(2 * time.Second)
+	for i := range 2 {
+		if delay, _ := l.reserve(time.Minute); delay != 0 {
+			t.Errorf("request %d waited %s, want a token earned per second", i+1, delay)
+		}
+	}
+	if delay := l.next(); !near(delay, time.Second) {
+		t.Errorf("next waits %s, want about a second", delay)
+	}
+
+	// a long quiet period refills no more than the burst
+	l.rewind(time.Hour)
+	for range 3 {
+		l.reserve(time.Minute)
+	}
+	if delay := l.next(); delay == 0 {
+		t.Error("bucket refilled past its burst")
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := newLimiter(0, 0)
+	for range 100 {
+		if delay, ok := l.reserve(time.Second); !ok || delay != 0 {
+			t.Fatalf("waited %s without a rate limit", delay)
+		}
+	}
+}
+
+func TestLimiterMaxWait(t *testing.T) {
+	l := newLimiter(60, 1)
+	l.reserve(time.Minute)
+
+	delay, ok := l.reserve(500 * time.Millisecond)
+	if ok || !near(delay, time.Second) {
+		t.Errorf("reserve = %s, %v, want a rejection about a second out", delay, ok)
+	}
+	if stats := l.stats(); stats.Rejected != 1 || stats.Requests != 1 {
+		t.Errorf("stats = %+v, want one request and one rejection", stats)
+	}
+	// the rejected caller's token was handed back
+	if delay := l.next(); !near(delay, time.Second) {
+		t.Errorf("next waits %s, want about a second", delay)
+	}
+}
+
+func TestLimiterSleepCancelled(t *testing.T) {
+	l := newLimiter(60, 1)
+	l.reserve(time.Minute)
+	delay, _ := l.reserve(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- l.sleep(ctx, delay) }()
+
+	deadline := time.Now().Add(time.Second)
+	for l.stats().QueueDepth != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("caller never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("sleep = %v, want context.Canceled", err)
+	}
+	if depth := l.stats().QueueDepth; depth != 0 {
+		t.Errorf("queue depth = %d after the caller left", depth)
+	}
+	// the cancelled caller's token was handed back
+	if delay := l.next(); !near(delay, time.Second) {
+		t.Errorf("next waits %s, want about a second", delay)
+	}
+}
+
+func TestLimiterPause(t *testing.T) {
+	l := newLimiter(60, 5)
+	l.pause(3 * time.Second)
+
+	if delay := l.next(); !near(delay, 3*time.Second) {
+		t.Errorf("next waits %s, want the three second pause", delay)
+	}
+	if _, ok := l.reserve(time.Second); ok {
+		t.Error("reserved a token through a pause longer than max wait")
+	}
+	// the bucket is emptied, so tokens are earned from the end of the pause
+	// rather than the burst being sent as soon as it ends
+	l.mu.Lock()
+	tokens := l.tokens
+	l.mu.Unlock()
+	if tokens > 0.01 {
+		t.Errorf("%g tokens left after a 429, want none", tokens)
+	}
+
+	l.pause(time.Millisecond)
+	if stats := l.stats(); stats.RateLimited != 2 {
+		t.Errorf("rate limited %d times, want 2", stats.RateLimited)
+	}
+	if delay := l.next(); !near(delay, 3*time.Second) {
+		t.Errorf("a shorter pause cut the longer one to %s", delay)
+	}
+}
+
+func TestClientRejectsLongWaits(t *testing.T) {
+	server := httptest.NewServer(serveJSON(t, "/breaches", `[]`))
+	defer server.Close()
+	client := NewClient(Config{APIKey: "test-key", BaseURL: server.URL, RequestsPerMinute: 60, MaxWait: 100 * time.Millisecond})
+
+	if _, err := client.AllBreaches(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.AllBreaches(context.Background(), "")
+	var rateLimited *RateLimitError
+	if !errors.As(err, &rateLimited) || !near(rateLimited.RetryAfter, time.Second) {
+		t.Errorf("second call = %v, want a RateLimitError about a second out", err)
+	}
+}
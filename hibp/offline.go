@@ -0,0 +1,170 @@
+package hibp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PasswordCounter counts how many times a password appears in Pwned
+// Passwords. It's implemented by Client, against the online API, and by
+// OfflinePasswords, against downloaded hash files.
+type PasswordCounter interface {
+	PwnedPasswordCount(ctx context.Context, password string, mode HashMode) (int, error)
+}
+
+var (
+	_ PasswordCounter = (*Client)(nil)
+	_ PasswordCounter = (*OfflinePasswords)(nil)
+)
+
+// ErrModeUnavailable is returned by OfflinePasswords when no file was
+// opened for the requested hash mode
+var ErrModeUnavailable = errors.New("hibp: no pwned passwords file for hash mode")
+
+// offlineLineSize is enough to hold a partial line followed by a full one;
+// the longest lines are a 40 character SHA1, a colon, a count and CRLF
+const offlineLineSize = 256
+
+// OfflinePasswords answers Pwned Passwords lookups from the "ordered by hash"
+// files produced by the Pwned Passwords downloader, with one "HASH:COUNT"
+// line per password. Lookups binary search the file, so it's never loaded
+// into memory.
+type OfflinePasswords struct {
+	files map[HashMode]*os.File
+	sizes map[HashMode]int64
+}
+
+// OpenOfflinePasswords opens the SHA1 and NTLM files; either path may be
+// empty if that mode isn't needed
+func OpenOfflinePasswords(sha1Path, ntlmPath string) (*OfflinePasswords, error) {
+	offline := &OfflinePasswords{
+		files: make(map[HashMode]*os.File),
+		sizes: make(map[HashMode]int64),
+	}
+
+	for mode, path := range map[HashMode]string{SHA1: sha1Path, NTLM: ntlmPath} {
+		if path == "" {
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			offline.Close()
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			offline.Close()
+			return nil, err
+		}
+		offline.files[mode] = file
+		offline.sizes[mode] = info.Size()
+	}
+
+	if len(offline.files) == 0 {
+		return nil, fmt.Errorf("hibp: no pwned passwords files given")
+	}
+	return offline, nil
+}
+
+// Close closes the underlying files
+func (o *OfflinePasswords) Close() error {
+	var err error
+	for _, file := range o.files {
+		if closeErr := file.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// PwnedPasswordCount returns the number of times password appears in the
+// file for mode, or 0 if it doesn't
+func (o *OfflinePasswords) PwnedPasswordCount(ctx context.Context, password string, mode HashMode) (int, error) {
+	if mode == "" {
+		mode = SHA1
+	}
+	file, ok := o.files[mode]
+	if !ok {
+		return 0, fmt.Errorf("%w %s", ErrModeUnavailable, mode)
+	}
+
+	hash, err := mode.Hash(password)
+	if err != nil {
+		return 0, err
+	}
+	return search(file, o.sizes[mode], hash)
+}
+
+// search binary searches the sorted file for hash. The invariant is that the
+// line for hash, if present, starts within [lo, hi).
+func search(file io.ReaderAt, size int64, hash string) (int, error) {
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := lineAt(file, mid)
+		if err != nil {
+			return 0, err
+		}
+		if line == nil {
+			hi = mid
+			continue
+		}
+
+		lineHash, countText, _ := strings.Cut(string(line), ":")
+		switch strings.Compare(strings.ToUpper(lineHash), hash) {
+		case 0:
+			count, err := strconv.Atoi(strings.TrimSpace(countText))
+			if err != nil {
+				return 0, fmt.Errorf("hibp: malformed pwned passwords line %q", line)
+			}
+			return count, nil
+		case -1:
+			lo = start + int64(len(line)) + 1
+		case 1:
+			hi = mid
+		}
+	}
+	return 0, nil
+}
+
+// lineAt returns the first complete line starting at or after offset, without
+// its line ending, or a nil line if there is none
+func lineAt(file io.ReaderAt, offset int64) (start int64, line []byte, err error) {
+	// read from the byte before offset so a line starting exactly at
+	// offset is recognized by the newline preceding it
+	readFrom := offset
+	if offset > 0 {
+		readFrom = offset - 1
+	}
+
+	buf := make([]byte, offlineLineSize)
+	n, err := file.ReadAt(buf, readFrom)
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+	buf = buf[:n]
+
+	if offset > 0 {
+		newline := bytes.IndexByte(buf, '\n')
+		if newline < 0 {
+			return 0, nil, nil
+		}
+		buf = buf[newline+1:]
+		start = readFrom + int64(newline) + 1
+	}
+	if len(buf) == 0 {
+		return 0, nil, nil
+	}
+
+	if end := bytes.IndexByte(buf, '\n'); end >= 0 {
+		buf = buf[:end]
+	}
+	return start, bytes.TrimRight(buf, "\r"), nil
+}
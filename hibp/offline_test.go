@@ -0,0 +1,193 @@
+package hibp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// hashLines returns the sorted "HASH:COUNT" lines of n passwords in mode,
+// each password%d appearing i+1 times
+func hashLines(t *testing.T, mode HashMode, n int) (lines []string, counts map[string]int) {
+	t.Helper()
+	counts = make(map[string]int)
+	for i := range n {
+		hash, err := mode.Hash(fmt.Sprintf("password%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[hash] = i + 1
+		lines = append(lines, fmt.Sprintf("%s:%d", hash, i+1))
+	}
+	sort.Strings(lines)
+	return lines, counts
+}
+
+func TestSearch(t *testing.T) {
+	lines, counts := hashLines(t, SHA1, 500)
+	files := map[string]string{
+		"lf":                  strings.Join(lines, "\n") + "\n",
+		"crlf":                strings.Join(lines, "\r\n") + "\r\n",
+		"no trailing newline": strings.Join(lines, "\r\n"),
+		"lowercase":           strings.ToLower(strings.Join(lines, "\n")),
+	}
+
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			file := strings.NewReader(contents)
+			size := int64(len(contents))
+			for hash, want := range counts {
+				if got, err := search(file, size, hash); err != nil || got != want {
+					t.Fatalf("search(%s) = %d, %v, want %d", hash, got, err, want)
+				}
+			}
+
+			// hashes before the first line, after the last and between
+			// every pair of neighbours
+			absent := []string{strings.Repeat("0", 40), strings.Repeat("F", 40)}
+			for _, line := range lines {
+				hash, _, _ := strings.Cut(line, ":")
+				absent = append(absent, hash+"0", hash[:39])
+			}
+			for _, hash := range absent {
+				if got, err := search(file, size, hash); err != nil || got != 0 {
+					t.Fatalf("search(%s) = %d, %v, want it absent", hash, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchEdges(t *testing.T) {
+	lines, _ := hashLines(t, SHA1, 1)
+	hash, _, _ := strings.Cut(lines[0], ":")
+
+	tests := []struct {
+		name, contents string
+		want           int
+	}{
+		{"one line", lines[0] + "\r\n", 1},
+		{"one line without a newline", lines[0], 1},
+		{"empty", "", 0},
+		{"blank line", "\r\n", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := strings.NewReader(test.contents)
+			if got, err := search(file, int64(len(test.contents)), hash); err != nil || got != test.want {
+				t.Errorf("search = %d, %v, want %d", got, err, test.want)
+			}
+		})
+	}
+
+	malformed := hash + ":many\n"
+	if _, err := search(strings.NewReader(malformed), int64(len(malformed)), hash); err == nil {
+		t.Error("malformed count wasn't reported")
+	}
+}
+
+func TestLineAt(t *testing.T) {
+	contents := "AAA:1\r\nBBB:2\r\nCCC:3"
+	tests := []struct {
+		offset int64
+		start  int64
+		line   string
+	}{
+		{0, 0, "AAA:1"},
+		{1, 7, "BBB:2"},
+		{6, 7, "BBB:2"},
+		{7, 7, "BBB:2"},
+		{8, 14, "CCC:3"},
+		{14, 14, "CCC:3"},
+		{15, 0, ""},
+		{int64(len(contents)), 0, ""},
+	}
+	for _, test := range tests {
+		start, line, err := lineAt(strings.NewReader(contents), test.offset)
+		if err != nil || start != test.start || string(line) != test.line {
+			t.Errorf("lineAt(%d) = %d, %q, %v, want %d, %q", test.offset, start, line, err, test.start, test.line)
+		}
+	}
+}
+
+func writeHashFile(t *testing.T, mode HashMode, n int) (path string, counts map[string]int) {
+	t.Helper()
+	lines, counts := hashLines(t, mode, n)
+	path = filepath.Join(t.TempDir(), string(mode)+".txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, counts
+}
+
+func TestOfflinePasswordCount(t *testing.T) {
+	sha1Path, _ := writeHashFile(t, SHA1, 100)
+	ntlmPath, _ := writeHashFile(t, NTLM, 50)
+
+	offline, err := OpenOfflinePasswords(sha1Path, ntlmPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offline.Close()
+
+	tests := []struct {
+		password string
+		mode     HashMode
+		want     int
+	}{
+		{"password7", SHA1, 8},
+		{"password7", "", 8},
+		{"password7", NTLM, 8},
+		{"password99", SHA1, 100},
+		// only in the SHA1 file
+		{"password99", NTLM, 0},
+		{"not pwned", SHA1, 0},
+	}
+	for _, test := range tests {
+		got, err := offline.PwnedPasswordCount(context.Background(), test.password, test.mode)
+		if err != nil || got != test.want {
+			t.Errorf("PwnedPasswordCount(%q, %q) = %d, %v, want %d", test.password, test.mode, got, err, test.want)
+		}
+	}
+}
+
+func TestOfflinePasswordsModes(t *testing.T) {
+	sha1Path, _ := writeHashFile(t, SHA1, 10)
+	offline, err := OpenOfflinePasswords(sha1Path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offline.Close()
+
+	if _, err := offline.PwnedPasswordCount(context.Background(), "password1", NTLM); !errors.Is(err, ErrModeUnavailable) {
+		t.Errorf("NTLM lookup = %v, want ErrModeUnavailable", err)
+	}
+	if _, err := offline.PwnedPasswordCount(context.Background(), "password1", "md5"); err == nil {
+		t.Error("looked up an unknown mode")
+	}
+
+	if _, err := OpenOfflinePasswords("", ""); err == nil {
+		t.Error("opened without any files")
+	}
+	if _, err := OpenOfflinePasswords(sha1Path, filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("opened a missing file")
+	}
+}
+
+func TestSearchLargeFile(t *testing.T) {
+	// enough lines that the search crosses many buffer-sized reads
+	lines, counts := hashLines(t, NTLM, 20000)
+	contents := []byte(strings.Join(lines, "\r\n") + "\r\n")
+	file := bytes.NewReader(contents)
+	for hash, want := range counts {
+		if got, err := search(file, int64(len(contents)), hash); err != nil || got != want {
+			t.Fatalf("search(%s) = %d, %v, want %d", hash, got, err, want)
+		}
+	}
+}
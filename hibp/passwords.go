@@ -0,0 +1,117 @@
+package hibp
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// PwnedPasswordsAPI URL of the Pwned Passwords k-anonymity API
+const PwnedPasswordsAPI = "https://api.pwnedpasswords.com/"
+
+// HashMode selects the hash Pwned Passwords are looked up by
+type HashMode string
+
+const (
+	// SHA1 looks passwords up by their SHA-1 hash
+	SHA1 HashMode = "sha1"
+
+	// NTLM looks passwords up by their NTLM hash, as stored by Windows
+	NTLM HashMode = "ntlm"
+)
+
+// Hash returns the uppercase hex hash of password in mode
+func (mode HashMode) Hash(password string) (string, error) {
+	switch mode {
+	case SHA1, "":
+		sum := sha1.Sum([]byte(password))
+		return strings.ToUpper(hex.EncodeToString(sum[:])), nil
+	case NTLM:
+		utf16le := make([]byte, 0, len(password)*2)
+		for _, unit := range utf16.Encode([]rune(password)) {
+			utf16le = append(utf16le, byte(unit), byte(unit>>8))
+		}
+		sum := md4(utf16le)
+		return strings.ToUpper(hex.EncodeToString(sum[:])), nil
+	}
+	return "", fmt.Errorf("hibp: unknown hash mode %q", mode)
+}
+
+// PwnedPasswordCount The Pwned Passwords API uses a k-Anonymity model that allows a password to be searched for by partial hash. Only the first 5 characters of the hash of password are sent; the count of times it appears in the data set is found among the returned suffixes. Returns 0 for passwords that haven't been pwned.
+func (c *Client) PwnedPasswordCount(ctx context.Context, password string, mode HashMode) (int, error) {
+	hash, err := mode.Hash(password)
+	if err != nil {
+		return 0, err
+	}
+
+	suffixes, err := c.PwnedPasswordRange(ctx, hash[:5], mode)
+	if err != nil {
+		return 0, err
+	}
+	return suffixes[hash[5:]], nil
+}
+
+// PwnedPasswordRange returns the hash suffixes, and the number of times each
+// appears in the data set, of every pwned password whose hash starts with the
+// 5 character prefix. Responses are requested with padding, and the padding
+// entries, which have a count of zero, are dropped.
+func (c *Client) PwnedPasswordRange(ctx context.Context, prefix string, mode HashMode) (map[string]int, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.passwordsURL, "/") + "/range/" + url.PathEscape(prefix))
+	if err != nil {
+		return nil, err
+	}
+	if mode == NTLM {
+		u.RawQuery = url.Values{"mode": {string(NTLM)}}.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set("Add-Padding", "true")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest:
+		return nil, fmt.Errorf("hibp: invalid hash prefix %q", prefix)
+	default:
+		return nil, fmt.Errorf("hibp: unexpected response %s", res.Status)
+	}
+
+	suffixes := make(map[string]int)
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		suffix, count, ok := parseRangeLine(scanner.Text())
+		if ok && count > 0 {
+			suffixes[suffix] = count
+		}
+	}
+	return suffixes, scanner.Err()
+}
+
+// parseRangeLine parses a "SUFFIX:COUNT" line of a range response
+func parseRangeLine(line string) (suffix string, count int, ok bool) {
+	suffix, countText, ok := strings.Cut(strings.TrimSpace(line), ":")
+	if !ok {
+		return "", 0, false
+	}
+	count, err := strconv.Atoi(countText)
+	if err != nil {
+		return "", 0, false
+	}
+	return strings.ToUpper(suffix), count, true
+}
@@ -0,0 +1,143 @@
+package hibp
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMD4(t *testing.T) {
+	// the test suite from RFC 1320, appendix A.5
+	tests := map[string]string{
+		"":                           "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"a":                          "bde52cb31de33e46245e05fbdbd6fb24",
+		"abc":                        "a448017aaf21d8525fc10ae87aa6729d",
+		"message digest":             "d9130a8164549fe818874806e1c7014b",
+		"abcdefghijklmnopqrstuvwxyz": "d79e1c308aa5bbcdeea8ed63df412da9",
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789": "043f8582f241db351ce627e153e7f0e4",
+		strings.Repeat("1234567890", 8):                                  "e33b4ddc9c38f2199c3e7b164fcc0536",
+	}
+	for input, want := range tests {
+		if sum := md4([]byte(input)); hex.EncodeToString(sum[:]) != want {
+			t.Errorf("md4(%q) = %x, want %s", input, sum, want)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	tests := []struct {
+		mode     HashMode
+		password string
+		want     string
+	}{
+		{SHA1, "password", "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8"},
+		{"", "password", "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8"},
+		{NTLM, "password", "8846F7EAEE8FB117AD06BDD830B7586C"},
+		{NTLM, "", "31D6CFE0D16AE931B73C59D7E0C089C0"},
+	}
+	for _, test := range tests {
+		if got, err := test.mode.Hash(test.password); err != nil || got != test.want {
+			t.Errorf("%q.Hash(%q) = %s, %v, want %s", test.mode, test.password, got, err, test.want)
+		}
+	}
+	if _, err := HashMode("md5").Hash("password"); err == nil {
+		t.Error("hashed with an unknown mode")
+	}
+}
+
+func TestParseRangeLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		suffix string
+		count  int
+		ok     bool
+	}{
+		{"1E4C9B93F3F0682250B6CF8331B7EE68FD8:10434004", "1E4C9B93F3F0682250B6CF8331B7EE68FD8", 10434004, true},
+		{"1e4c9b93f3f0682250b6cf8331b7ee68fd8:3\r", "1E4C9B93F3F0682250B6CF8331B7EE68FD8", 3, true},
+		{"00000000000000000000000000000000000:0", "00000000000000000000000000000000000", 0, true},
+		{"1E4C9B93F3F0682250B6CF8331B7EE68FD8", "", 0, false},
+		{"1E4C9B93F3F0682250B6CF8331B7EE68FD8:many", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, test := range tests {
+		suffix, count, ok := parseRangeLine(test.line)
+		if suffix != test.suffix || count != test.count || ok != test.ok {
+			t.Errorf("parseRangeLine(%q) = %q, %d, %v", test.line, suffix, count, ok)
+		}
+	}
+}
+
+// rangeBody is a padded range response for 5BAA6 with CRLF line endings, as
+// Pwned Passwords serves it
+const rangeBody = "003D68EB55068C33ACE09247EE4C639306B:3\r\n" +
+	"1E4C9B93F3F0682250B6CF8331B7EE68FD8:10434004\r\n" +
+	"1D2DA4053E34E76F6576ED1DA63134B5E2A:0\r\n" +
+	"01330C689E5D64F660D6947A93AD634EF8F:0"
+
+// ntlmRangeBody is a range response for 8846F in NTLM mode, whose suffixes
+// are 27 characters long
+const ntlmRangeBody = "0A4B6C4D1C33A1F7CA5D0CF40E7:0\r\n" +
+	"7EAEE8FB117AD06BDD830B7586C:8846\r\n"
+
+func newRangeClient(t *testing.T, wantQuery string) *Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Add-Padding") != "true" {
+			t.Errorf("Add-Padding = %q", r.Header.Get("Add-Padding"))
+		}
+		if r.Header.Get("hibp-api-key") != "" {
+			t.Error("API key sent to Pwned Passwords")
+		}
+		if r.URL.RawQuery != wantQuery {
+			t.Errorf("query = %q, want %q", r.URL.RawQuery, wantQuery)
+		}
+		switch prefix := strings.TrimPrefix(r.URL.Path, "/range/"); {
+		case prefix == "5BAA6":
+			w.Write([]byte(rangeBody))
+		case prefix == "8846F":
+			w.Write([]byte(ntlmRangeBody))
+		case len(prefix) != 5:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return NewClient(Config{APIKey: "test-key", PwnedPasswordsURL: server.URL})
+}
+
+func TestPwnedPasswordRange(t *testing.T) {
+	client := newRangeClient(t, "")
+	suffixes, err := client.PwnedPasswordRange(context.Background(), "5BAA6", SHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		"003D68EB55068C33ACE09247EE4C639306B": 3,
+		"1E4C9B93F3F0682250B6CF8331B7EE68FD8": 10434004,
+	}
+	if !reflect.DeepEqual(suffixes, want) {
+		t.Errorf("got %v, want %v without the padding", suffixes, want)
+	}
+
+	if _, err := client.PwnedPasswordRange(context.Background(), "XYZ", SHA1); err == nil {
+		t.Error("invalid prefix didn't fail")
+	}
+}
+
+func TestPwnedPasswordCount(t *testing.T) {
+	client := newRangeClient(t, "")
+	if count, err := client.PwnedPasswordCount(context.Background(), "password", SHA1); err != nil || count != 10434004 {
+		t.Errorf("count = %d, %v, want 10434004", count, err)
+	}
+	if count, err := client.PwnedPasswordCount(context.Background(), "password1", SHA1); err != nil || count != 0 {
+		t.Errorf("count = %d, %v, want an unpwned password to have none", count, err)
+	}
+
+	client = newRangeClient(t, "mode=ntlm")
+	if count, err := client.PwnedPasswordCount(context.Background(), "password", NTLM); err != nil || count != 8846 {
+		t.Errorf("count = %d, %v, want the NTLM range's 8846", count, err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/audibleblink/passdb/hibp"
+	"github.com/go-chi/chi"
+	"go.etcd.io/bbolt"
+)
+
+var logoDir = getEnv("BREACH_LOGO_DIR", "./logos")
+
+const (
+	catalogLogosBucket = "logos"
+
+	// maxLogoSize bounds downloads; HIBP's logos are a few kilobytes
+	maxLogoSize = 1 << 20
+
+	// logoFetchers is how many logos a catalog sync downloads at once
+	logoFetchers = 4
+)
+
+var logoHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// logoContentTypes are the image types logos are accepted in. SVG is left
+// out: it can carry script, and logos are served from the API's origin.
+var logoContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// logoEntry records which blob in the logo store holds a breach's logo, and
+// the URL it was downloaded from so a changed logo is fetched again
+type logoEntry struct {
+	Hash        string `json:"hash"`
+	ContentType string `json:"content_type"`
+	Source      string `json:"source"`
+}
+
+// logoURL is the local URL a breach's logo is served from. Logos are only
+// proxied when the catalog is available to index them.
+func logoURL(name, source string) string {
+	if catalog == nil || name == "" || source == "" {
+		return source
+	}
+	return "/api/v1/logos/" + url.PathEscape(name)
+}
+
+// logoPath is where the blob with the given SHA-256 lives in the store
+func logoPath(hash string) string {
+	return filepath.Join(logoDir, hash[:2], hash)
+}
+
+// logo returns the store entry for a breach's logo, or nil if it hasn't been
+// downloaded
+func (c *breachCatalog) logo(name string) (entry *logoEntry, err error) {
+	err = c.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(catalogLogosBucket)).Get(catalogKey(name))
+		if data == nil {
+			return nil
+		}
+		entry = &logoEntry{}
+		return json.Unmarshal(data, entry)
+	})
+	if entry != nil {
+		if _, statErr := os.Stat(logoPath(entry.Hash)); statErr != nil {
+			entry = nil
+		}
+	}
+	return
+}
+
+// fetchLogo downloads the logo at source into the store and indexes it under
+// name. Identical logos share a single blob.
+func (c *breachCatalog) fetchLogo(ctx context.Context, name, source string) (*logoEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := logoHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching logo %s: unexpected response %s", source, res.Status)
+	}
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if !logoContentTypes[contentType] {
+		return nil, fmt.Errorf("fetching logo %s: unsupported content type %q", source, contentType)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxLogoSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxLogoSize {
+		return nil, fmt.Errorf("fetching logo %s: larger than %d bytes", source, maxLogoSize)
+	}
+
+	sum := sha256.Sum256(data)
+	entry := &logoEntry{
+		Hash:        hex.EncodeToString(sum[:]),
+		ContentType: contentType,
+		Source:      source,
+	}
+	if err := writeLogo(entry.Hash, data); err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	err = c.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(catalogLogosBucket)).Put(catalogKey(name), encoded)
+	})
+	return entry, err
+}
+
+// writeLogo stores a blob, writing to a temporary file first so readers never
+// see a partial logo
+func writeLogo(hash string, data []byte) error {
+	path := logoPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fetchLogosInBackground fetches the logos of breaches unless an earlier pass
+// is still running, in which case the ones it misses are fetched on their
+// first request
+func (c *breachCatalog) fetchLogosInBackground(ctx context.Context, breaches []hibp.BreachModel) {
+	if !c.fetchingLogos.TryLock() {
+		return
+	}
+	go func() {
+		defer c.fetchingLogos.Unlock()
+		c.fetchLogos(ctx, breaches)
+	}()
+}
+
+// fetchLogos downloads the logos of breaches that are missing from the store
+// or whose logo URL has changed. Failures are logged and retried on the next
+// sync or request.
+func (c *breachCatalog) fetchLogos(ctx context.Context, breaches []hibp.BreachModel) {
+	work := make(chan hibp.BreachModel)
+	var wg sync.WaitGroup
+	for i := 0; i < logoFetchers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for breach := range work {
+				if _, err := c.fetchLogo(ctx, breach.Name, breach.LogoPath); err != nil {
+					log.Printf("Failed to fetch logo for %s: %v", breach.Name, err)
+				}
+			}
+		}()
+	}
+
+	for _, breach := range breaches {
+		if breach.LogoPath == "" {
+			continue
+		}
+		entry, err := c.logo(breach.Name)
+		if err == nil && entry != nil && entry.Source == breach.LogoPath {
+			continue
+		}
+		work <- breach
+	}
+	close(work)
+	wg.Wait()
+}
+
+// handleLogo serves a breach's logo from the store, downloading it first if
+// this is the first request for it
+func handleLogo(w http.ResponseWriter, r *http.Request) {
+	if catalog == nil {
+		JSONError(w, fmt.Errorf("breach catalog is not available"), http.StatusServiceUnavailable)
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	entry, err := catalog.logo(name)
+	if err != nil {
+		JSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if entry == nil {
+		found, err := providerBreachByName(r.Context(), name)
+		if err != nil {
+			hibpError(w, err)
+			return
+		}
+		if found.LogoPath == "" {
+			hibpError(w, hibp.ErrNotFound)
+			return
+		}
+		if entry, err = catalog.fetchLogo(r.Context(), name, found.LogoPath); err != nil {
+			JSONError(w, err, http.StatusBadGateway)
+			return
+		}
+	}
+
+	file, err := os.Open(logoPath(entry.Hash))
+	if errors.Is(err, os.ErrNotExist) {
+		JSONError(w, fmt.Errorf("logo for %s is missing from the store", name), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		JSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("ETag", `"`+entry.Hash+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	// logos are third-party content, so don't let browsers sniff or run them
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'")
+	http.ServeContent(w, r, "", time.Time{}, file)
+}
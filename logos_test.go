@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// useLogoStore points the logo store at a temporary directory for the test
+func useLogoStore(t *testing.T) {
+	t.Helper()
+	previous := logoDir
+	logoDir = t.TempDir()
+	t.Cleanup(func() { logoDir = previous })
+}
+
+func TestFetchLogoRejectsNonRasterImages(t *testing.T) {
+	useCatalog(t)
+	useLogoStore(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"/>`))
+	}))
+	defer server.Close()
+
+	for contentType, allowed := range map[string]bool{
+		"image/png":                true,
+		"image/webp":               true,
+		"image/svg+xml":            false,
+		"text/html; charset=utf-8": false,
+	} {
+		_, err := catalog.fetchLogo(context.Background(), "Adobe", server.URL+"/?type="+url.QueryEscape(contentType))
+		if allowed && err != nil {
+			t.Errorf("%s: %v", contentType, err)
+		}
+		if !allowed && err == nil {
+			t.Errorf("%s: logo was accepted", contentType)
+		}
+	}
+}
+
+func TestHandleLogoHeaders(t *testing.T) {
+	useCatalog(t)
+	useLogoStore(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}))
+	defer server.Close()
+	if _, err := catalog.fetchLogo(context.Background(), "Adobe", server.URL+"/Adobe.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/logos/{name}", handleLogo)
+	rec := get(router, "/logos/Adobe")
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	for header, want := range map[string]string{
+		"Content-Type":            "image/png",
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "sandbox; default-src 'none'",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestSyncDoesNotWaitForLogos(t *testing.T) {
+	useCatalog(t)
+	useLogoStore(t)
+	release := make(chan struct{})
+	logos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}))
+	defer logos.Close()
+	useHIBP(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dataclasses" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[{"Name":"Adobe","LogoPath":"` + logos.URL + `/Adobe.png"}]`))
+	})
+
+	// the sync's client goes away as soon as it has its answer
+	ctx, cancel := context.WithCancel(context.Background())
+	synced := make(chan error)
+	go func() {
+		_, err := catalog.sync(ctx, hibpClient)
+		synced <- err
+	}()
+	select {
+	case err := <-synced:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("sync waited for the logo downloads")
+	}
+	cancel()
+	close(release)
+
+	// wait for the background pass
+	catalog.fetchingLogos.Lock()
+	catalog.fetchingLogos.Unlock()
+	if entry, err := catalog.logo("Adobe"); err != nil || entry == nil {
+		t.Errorf("logo = %+v, %v, want it fetched despite the cancelled sync", entry, err)
+	}
+}
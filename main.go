@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"cloud.google.com/go/bigquery"
@@ -23,30 +26,123 @@ var (
 	bigQueryTable = os.Getenv("GOOGLE_BIGQUERY_TABLE")
 	googleCred    = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
 	hibpKey       = os.Getenv("HIBP_API_KEY")
+	hibpURL       = os.Getenv("HIBP_API_URL")
 
 	listenAddr = ":3000"
 	bq         *bigquery.Client
+	hibpClient *hibp.Client
+
+	// pwnedPasswords answers /passwords/{password}/pwned, from the online
+	// API by default or from local hash files for air-gapped use
+	pwnedPasswords       hibp.PasswordCounter
+	pwnedPasswordsSource = getEnv("PWNED_PASSWORDS_SOURCE", "hibp")
 )
 
-func init() {
-	var err error
-	if projectID == "" || bigQueryTable == "" || googleCred == "" || hibpKey == "" {
-		err = fmt.Errorf("missing required environment variables")
+// commands run in place of the server when named as the first argument, e.g.
+// `passdb import-potfile hashcat.potfile`
+var commands = map[string]func(args []string) error{
+	"import-potfile":    runImportPotfile,
+	"build-range-index": runBuildRangeIndex,
+	"export-bloom":      runExportBloom,
+}
+
+// setup connects the clients the server needs, exiting if it's misconfigured
+func setup() {
+	if hibpKey == "" {
+		log.Fatal(fmt.Errorf("missing required environment variables"))
+	}
+	hibpClient = hibp.NewClient(hibp.Config{
+		Keys:    parseHIBPKeys(hibpKey, getEnvInt("HIBP_RATE_LIMIT", 10)),
+		BaseURL: hibpURL,
+
+		PwnedPasswordsURL: os.Getenv("PWNED_PASSWORDS_URL"),
+
+		Timeout: getEnvDuration("HIBP_TIMEOUT", hibp.DefaultTimeout),
+		MaxWait: getEnvDuration("HIBP_MAX_WAIT", hibp.DefaultMaxWait),
+
+		QuarantineAfter: getEnvInt("HIBP_QUARANTINE_AFTER", hibp.DefaultQuarantineAfter),
+		QuarantineFor:   getEnvDuration("HIBP_QUARANTINE_FOR", hibp.DefaultQuarantineFor),
+	})
+	if err := loadBreachProviders(); err != nil {
+		log.Fatal(err)
+	}
+	if err := connectBigQuery(); err != nil {
 		log.Fatal(err)
 	}
 
-	if len(os.Args) > 1 {
-		listenAddr = os.Args[1]
+	switch pwnedPasswordsSource {
+	case "hibp":
+		pwnedPasswords = hibpClient
+	case "offline":
+		offline, err := hibp.OpenOfflinePasswords(
+			os.Getenv("PWNED_PASSWORDS_SHA1_FILE"),
+			os.Getenv("PWNED_PASSWORDS_NTLM_FILE"),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pwnedPasswords = offline
+	default:
+		log.Fatal(fmt.Errorf("PWNED_PASSWORDS_SOURCE must be hibp or offline"))
+	}
+}
+
+// parseHIBPKeys parses a comma-separated list of API keys, each optionally
+// followed by its own requests-per-minute limit, e.g. "key1:10,key2:50"
+func parseHIBPKeys(value string, defaultRPM int) (keys []hibp.Key) {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key := hibp.Key{APIKey: entry, RequestsPerMinute: defaultRPM}
+		if apiKey, rpm, ok := strings.Cut(entry, ":"); ok {
+			if parsed, err := strconv.Atoi(rpm); err == nil {
+				key.APIKey, key.RequestsPerMinute = apiKey, parsed
+			}
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+func connectBigQuery() (err error) {
+	if projectID == "" || bigQueryTable == "" || googleCred == "" {
+		return fmt.Errorf("missing required environment variables")
 	}
 
 	ctx := context.Background()
 	bq, err = bigquery.NewClient(ctx, projectID)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		listenAddr = os.Args[1]
+	}
+	setup()
+
+	var err error
+	catalog, err = openBreachCatalog(catalogPath)
+	if err != nil {
+		log.Printf("Failed to open breach catalog: %v", err)
+	} else if catalogSyncInterval > 0 {
+		go catalog.syncPeriodically(hibpClient, catalogSyncInterval)
+	}
+
+	for _, index := range []*readOnlyDB{rangeIndex, potfiles} {
+		if err := index.open(); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to open %s: %v", index.path, err)
+		}
+	}
+
 	cacheConfig := LoadCacheConfig()
 
 	r := chi.NewRouter()
@@ -67,9 +163,30 @@ func main() {
 		// Password database endpoints
 		r.Get("/usernames/{username}", handleUsername)
 		r.Get("/passwords/{password}", handlePassword)
+		r.Get("/passwords/{password}/pwned", handlePwnedPassword)
+		r.Post("/passwords/pwned", handlePwnedPassword)
 		r.Get("/domains/{domain}", handleDomain)
+		r.Get("/domains/{domain}/stats", handleDomainStats)
+		r.Get("/domains/{domain}/breaches", handleDomainSearch)
 		r.Get("/emails/{email}", handleEmail)
+		r.Get("/emails/{email}/timeline", handleTimeline)
+		r.Get("/breaches", handleDomainBreaches)
 		r.Get("/breaches/{email}", handleBreaches)
+		r.Get("/breaches/{email}/dataclasses", handleBreachDataClasses)
+		r.Get("/breach/{name}", handleBreach)
+		r.Get("/logos/{name}", handleLogo)
+		r.Get("/pastes/{email}", handlePastes)
+		r.Get("/dataclasses", handleDataClasses)
+		r.Get("/breach-catalog", handleCatalogStatus)
+		r.Post("/breach-catalog/sync", handleCatalogSync)
+		r.Get("/hibp/stats", handleHIBPStats)
+		r.Get("/hibp/keys", handleHIBPKeys)
+
+		// k-anonymity password range lookups
+		r.Get("/range/{prefix}", handleRange)
+
+		// Bloom filter of leaked passwords for offline checks
+		r.Get("/bloom", handleBloom)
 
 		// Cache management endpoints
 		r.Get("/cache/stats", handleCacheStats)
@@ -80,7 +197,7 @@ func main() {
 	log.Printf("Starting server on %s\n", listenAddr)
 	log.Printf("API endpoints available at /api/v1/")
 	log.Printf("Static files served from /")
-	err := http.ListenAndServe(listenAddr, r)
+	err = http.ListenAndServe(listenAddr, r)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -90,15 +207,29 @@ type record struct {
 	Username bigquery.NullString `json:"username"`
 	Domain   bigquery.NullString `json:"domain"`
 	Password bigquery.NullString `json:"password"`
+
+	// HashType is read from a hash_type column when the table was classified
+	// during import, and computed at query time otherwise
+	HashType string           `json:"hash_type,omitempty" bigquery:"hash_type"`
+	Cracked  *crackedPassword `json:"cracked,omitempty" bigquery:"-"`
+	Strength *strength        `json:"strength,omitempty" bigquery:"-"`
 }
 
 type breach struct {
-	Title       string
-	Domain      string
-	Date        string
-	Count       int
-	Description string
-	LogoPath    string
+	Name         string
+	Title        string
+	Domain       string
+	Date         string
+	AddedDate    string
+	Count        int
+	Description  string
+	LogoPath     string
+	DataClasses  []string
+	IsVerified   bool
+	IsSensitive  bool
+	IsFabricated bool
+	IsSpamList   bool
+	Sources      []string
 }
 
 func handleUsername(w http.ResponseWriter, r *http.Request) {
@@ -108,7 +239,7 @@ func handleUsername(w http.ResponseWriter, r *http.Request) {
 		JSONError(w, err, http.StatusInternalServerError)
 		return
 	}
-	resultWriter(w, records)
+	resultWriter(w, r, records)
 }
 
 func handlePassword(w http.ResponseWriter, r *http.Request) {
@@ -118,7 +249,46 @@ func handlePassword(w http.ResponseWriter, r *http.Request) {
 		JSONError(w, err, http.StatusInternalServerError)
 		return
 	}
-	resultWriter(w, records)
+	resultWriter(w, r, records)
+}
+
+type pwnedPassword struct {
+	Count  int           `json:"count"`
+	Mode   hibp.HashMode `json:"mode"`
+	Source string        `json:"source"`
+}
+
+// handlePwnedPassword looks the password up in HIBP's Pwned Passwords. It
+// takes the password from the URL, or from a JSON body of the form
+// {"password": "...", "mode": "ntlm"} when POSTed so it stays out of logs.
+func handlePwnedPassword(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Password string        `json:"password"`
+		Mode     hibp.HashMode `json:"mode"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			JSONError(w, fmt.Errorf("invalid request body: %w", err), http.StatusBadRequest)
+			return
+		}
+	} else {
+		request.Password = chi.URLParam(r, "password")
+		request.Mode = hibp.HashMode(r.URL.Query().Get("mode"))
+	}
+	if request.Mode == "" {
+		request.Mode = hibp.SHA1
+	}
+	if request.Mode != hibp.SHA1 && request.Mode != hibp.NTLM {
+		JSONError(w, fmt.Errorf("mode must be sha1 or ntlm"), http.StatusBadRequest)
+		return
+	}
+
+	count, err := pwnedPasswords.PwnedPasswordCount(r.Context(), request.Password, request.Mode)
+	if err != nil {
+		hibpError(w, err)
+		return
+	}
+	jsonWriter(w, pwnedPassword{Count: count, Mode: request.Mode, Source: pwnedPasswordsSource})
 }
 
 func handleDomain(w http.ResponseWriter, r *http.Request) {
@@ -128,7 +298,17 @@ func handleDomain(w http.ResponseWriter, r *http.Request) {
 		JSONError(w, err, http.StatusInternalServerError)
 		return
 	}
-	resultWriter(w, records)
+	resultWriter(w, r, records)
+}
+
+func handleDomainStats(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	stats, err := statsByDomain(domain)
+	if err != nil {
+		JSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+	jsonWriter(w, stats)
 }
 
 func handleEmail(w http.ResponseWriter, r *http.Request) {
@@ -138,36 +318,189 @@ func handleEmail(w http.ResponseWriter, r *http.Request) {
 		JSONError(w, err, http.StatusBadRequest)
 		return
 	}
-	resultWriter(w, records)
+	resultWriter(w, r, records)
 }
 
 func handleBreaches(w http.ResponseWriter, r *http.Request) {
-	email := chi.URLParam(r, "email")
-	hibpBreaches, err := hibp.BreachedAccount(email, "", false, true)
+	breaches, ok := filteredBreaches(w, r, func(ctx context.Context) ([]*providerBreach, providerErrors, error) {
+		return breachesByEmail(ctx, chi.URLParam(r, "email"))
+	})
+	if !ok {
+		return
+	}
+
+	data, err := json.Marshal(breaches)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Write(data)
+}
+
+// handleBreachDataClasses returns the union of the data classes exposed
+// across the breaches an email appears in
+func handleBreachDataClasses(w http.ResponseWriter, r *http.Request) {
+	breaches, ok := filteredBreaches(w, r, func(ctx context.Context) ([]*providerBreach, providerErrors, error) {
+		return breachesByEmail(ctx, chi.URLParam(r, "email"))
+	})
+	if !ok {
+		return
+	}
+	jsonWriter(w, unionDataClasses(breaches))
+}
+
+// handleDomainBreaches returns the breaches of the site at the domain query
+// parameter, e.g. /breaches?domain=adobe.com
+func handleDomainBreaches(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		JSONError(w, fmt.Errorf("missing domain parameter"), http.StatusBadRequest)
+		return
+	}
+
+	breaches, ok := filteredBreaches(w, r, func(ctx context.Context) ([]*providerBreach, providerErrors, error) {
+		return breachesByDomain(ctx, domain)
+	})
+	if !ok {
+		return
+	}
+	if breaches == nil {
+		breaches = []*breach{}
+	}
+	jsonWriter(w, breaches)
+}
+
+// filteredBreaches runs a lookup across the breach providers and applies the
+// query filters, writing an error response and returning false on failure.
+// Providers that failed while others answered are listed in the
+// X-Breach-Provider-Errors header, and the partial result isn't cached.
+func filteredBreaches(
+	w http.ResponseWriter,
+	r *http.Request,
+	lookup func(ctx context.Context) ([]*providerBreach, providerErrors, error),
+) ([]*breach, bool) {
+	filter, err := parseBreachFilter(r)
+	if err != nil {
+		JSONError(w, err, http.StatusBadRequest)
+		return nil, false
+	}
+	format, err := parseDescriptionFormat(r)
+	if err != nil {
+		JSONError(w, err, http.StatusBadRequest)
+		return nil, false
+	}
+
+	found, failed, err := lookup(r.Context())
+	if err != nil {
+		hibpError(w, err)
+		return nil, false
+	}
+	reportProviderErrors(w, failed)
 
 	var breaches []*breach
-	for _, hibpBreach := range hibpBreaches {
-		breach := &breach{
-			Title:       hibpBreach.Title,
-			Domain:      hibpBreach.Domain,
-			Date:        hibpBreach.BreachDate,
-			Count:       hibpBreach.PwnCount,
-			Description: hibpBreach.Description,
-			LogoPath:    hibpBreach.LogoPath,
+	for _, found := range found {
+		if !filter.matches(found.BreachModel) {
+			continue
 		}
-		breaches = append(breaches, breach)
+		breaches = append(breaches, &breach{
+			Name:         found.Name,
+			Title:        found.Title,
+			Domain:       found.Domain,
+			Date:         found.BreachDate,
+			AddedDate:    found.AddedDate,
+			Count:        found.PwnCount,
+			Description:  renderDescription(found.Description, format),
+			LogoPath:     logoURL(found.Name, found.LogoPath),
+			DataClasses:  found.DataClasses,
+			IsVerified:   found.IsVerified,
+			IsSensitive:  found.IsSensitive,
+			IsFabricated: found.IsFabricated,
+			IsSpamList:   found.IsSpamList,
+			Sources:      found.Sources,
+		})
 	}
+	return breaches, true
+}
 
-	data, err := json.Marshal(breaches)
+func handleBreach(w http.ResponseWriter, r *http.Request) {
+	format, err := parseDescriptionFormat(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		JSONError(w, err, http.StatusBadRequest)
 		return
 	}
-	w.Write(data)
+
+	name := chi.URLParam(r, "name")
+	found, err := providerBreachByName(r.Context(), name)
+	if err != nil {
+		hibpError(w, err)
+		return
+	}
+	found.Description = renderDescription(found.Description, format)
+	found.LogoPath = logoURL(found.Name, found.LogoPath)
+	jsonWriter(w, found)
+}
+
+func handlePastes(w http.ResponseWriter, r *http.Request) {
+	email := chi.URLParam(r, "email")
+	pastes, err := hibpClient.PasteAccount(r.Context(), email)
+	if errors.Is(err, hibp.ErrNotFound) {
+		pastes, err = []hibp.PasteModel{}, nil
+	}
+	if err != nil {
+		hibpError(w, err)
+		return
+	}
+	jsonWriter(w, pastes)
+}
+
+func handleDataClasses(w http.ResponseWriter, r *http.Request) {
+	var dataClasses []string
+	if catalog != nil {
+		var err error
+		if dataClasses, err = catalog.dataClasses(); err != nil {
+			log.Printf("Failed to read breach catalog: %v", err)
+		}
+	}
+	if dataClasses == nil {
+		var err error
+		if dataClasses, err = hibpClient.DataClasses(r.Context()); err != nil {
+			hibpError(w, err)
+			return
+		}
+	}
+	jsonWriter(w, dataClasses)
+}
+
+// hibpError writes an error from the hibp client with a status code that
+// reflects where the failure happened
+func hibpError(w http.ResponseWriter, err error) {
+	var rateLimited *hibp.RateLimitError
+	switch {
+	case errors.As(err, &rateLimited):
+		retryAfter := int(math.Ceil(rateLimited.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		JSONError(w, err, http.StatusTooManyRequests)
+	case errors.Is(err, hibp.ErrNotFound):
+		JSONError(w, err, http.StatusNotFound)
+	case errors.Is(err, hibp.ErrBadRequest), errors.Is(err, hibp.ErrModeUnavailable):
+		JSONError(w, err, http.StatusBadRequest)
+	case errors.Is(err, hibp.ErrUnauthorized):
+		JSONError(w, err, http.StatusBadGateway)
+	case errors.Is(err, hibp.ErrForbidden):
+		JSONError(w, err, http.StatusForbidden)
+	case errors.Is(err, context.DeadlineExceeded):
+		JSONError(w, err, http.StatusGatewayTimeout)
+	default:
+		JSONError(w, err, http.StatusInternalServerError)
+	}
+}
+
+func handleHIBPStats(w http.ResponseWriter, r *http.Request) {
+	jsonWriter(w, hibpClient.Stats())
+}
+
+func handleHIBPKeys(w http.ResponseWriter, r *http.Request) {
+	jsonWriter(w, hibpClient.KeyStats())
 }
 
 func recordsByUsername(username string) (records []*record, err error) {
@@ -202,6 +535,54 @@ func recordsByEmail(email string) (records []*record, err error) {
 	return queryRecords(query)
 }
 
+type domainStats struct {
+	Domain    string           `json:"domain"`
+	Records   int64            `json:"records"`
+	Usernames int64            `json:"usernames"`
+	HashTypes map[string]int64 `json:"hash_types"`
+}
+
+func statsByDomain(domain string) (stats *domainStats, err error) {
+	stats = &domainStats{Domain: domain, HashTypes: make(map[string]int64)}
+	params := map[string]string{"domain": domain}
+
+	totalsQuery := parameterize(fmt.Sprintf(
+		`SELECT COUNT(*) AS records, COUNT(DISTINCT username) AS usernames
+		FROM %s WHERE domain = @domain`,
+		bigQueryTable,
+	), params)
+
+	var totals struct {
+		Records   int64 `bigquery:"records"`
+		Usernames int64 `bigquery:"usernames"`
+	}
+	err = readRows(context.Background(), totalsQuery, &totals, func() {
+		stats.Records = totals.Records
+		stats.Usernames = totals.Usernames
+	})
+	if err != nil {
+		return
+	}
+
+	typesQuery := parameterize(fmt.Sprintf(
+		`SELECT %s AS hash_type, COUNT(*) AS count
+		FROM %s WHERE domain = @domain GROUP BY hash_type`,
+		hashTypeSQL("password"),
+		bigQueryTable,
+	), params)
+
+	var row struct {
+		HashType bigquery.NullString `bigquery:"hash_type"`
+		Count    int64               `bigquery:"count"`
+	}
+	err = readRows(context.Background(), typesQuery, &row, func() {
+		if row.HashType.Valid {
+			stats.HashTypes[row.HashType.StringVal] = row.Count
+		}
+	})
+	return
+}
+
 func recordsBy(column, value string) (records []*record, err error) {
 	queryString := fmt.Sprintf(
 		`SELECT DISTINCT * FROM %s WHERE %s = @%s`,
@@ -243,12 +624,70 @@ func queryRecords(query *bigquery.Query) (records []*record, err error) {
 		if err != nil {
 			return
 		}
+		if r.HashType == "" {
+			r.HashType = classifyPassword(r.Password.StringVal)
+		}
 		records = append(records, &r)
 	}
+
+	crackRecords(records)
 	return
 }
 
-func resultWriter(w http.ResponseWriter, records []*record) {
+// readRows runs query, loading each row into dst and calling fn after each
+func readRows(ctx context.Context, query *bigquery.Query, dst interface{}, fn func()) error {
+	results, err := query.Read(ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		err = results.Next(dst)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn()
+	}
+}
+
+func resultWriter(w http.ResponseWriter, r *http.Request, records []*record) {
+	var hashed *bool
+	if value := r.URL.Query().Get("hashed"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			JSONError(w, fmt.Errorf("invalid value for hashed: %q", value), http.StatusBadRequest)
+			return
+		}
+		hashed = &parsed
+	}
+
+	hashTypes := make(map[string]bool)
+	if value := r.URL.Query().Get("hash_type"); value != "" {
+		for _, hashType := range strings.Split(value, ",") {
+			hashTypes[strings.ToLower(strings.TrimSpace(hashType))] = true
+		}
+	}
+	records = filterRecords(records, hashed, hashTypes)
+
+	if queryFlag(r, "strength") {
+		for _, rec := range records {
+			password := rec.Password.StringVal
+			if rec.Cracked != nil {
+				password = rec.Cracked.Plaintext
+			} else if rec.HashType != hashTypePlaintext {
+				continue
+			}
+			rec.Strength = scorePassword(
+				password,
+				rec.Username.StringVal,
+				rec.Domain.StringVal,
+			)
+		}
+	}
+
 	resultJSON, err := json.Marshal(records)
 	if err != nil {
 		JSONError(w, err, http.StatusInternalServerError)
@@ -258,6 +697,22 @@ func resultWriter(w http.ResponseWriter, records []*record) {
 	w.Write(resultJSON)
 }
 
+// queryFlag reports whether the boolean query parameter name is set to a true
+// value, e.g. ?strength=true or ?strength=1
+func queryFlag(r *http.Request, name string) bool {
+	value, err := strconv.ParseBool(r.URL.Query().Get(name))
+	return err == nil && value
+}
+
+func jsonWriter(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		JSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
 type JSONErr struct {
 	Status int    `json:"status"`
 	Error  string `json:"error"`
@@ -326,6 +781,13 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 		"service": "passdb-api",
 		"version": "v1",
 	}
+	if cacheDB != nil {
+		if err := cacheDB.healthy(); err != nil {
+			response["status"] = "degraded"
+			response["cache"] = err.Error()
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
 
 	json.NewEncoder(w).Encode(response)
 }
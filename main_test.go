@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/audibleblink/passdb/hibp"
+)
+
+func TestHIBPErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{&hibp.RateLimitError{RetryAfter: 1500 * time.Millisecond}, http.StatusTooManyRequests},
+		{hibp.ErrNotFound, http.StatusNotFound},
+		{hibp.ErrBadRequest, http.StatusBadRequest},
+		{hibp.ErrModeUnavailable, http.StatusBadRequest},
+		{hibp.ErrUnauthorized, http.StatusBadGateway},
+		{hibp.ErrForbidden, http.StatusForbidden},
+		{fmt.Errorf("lookup: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{fmt.Errorf("wrapped: %w", hibp.ErrNotFound), http.StatusNotFound},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.err.Error(), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			hibpError(rec, test.err)
+			if rec.Code != test.want {
+				t.Errorf("status = %d, want %d", rec.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestHIBPErrorRetryAfter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	hibpError(rec, &hibp.RateLimitError{RetryAfter: 1500 * time.Millisecond})
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+}
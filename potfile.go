@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var potfileDBPath = getEnv("POTFILE_DB_PATH", "./potfile.db")
+
+const (
+	potfileBucket    = "potfile"
+	potfileBatchSize = 10000
+)
+
+// crackedPassword is the plaintext recovered for a hashed password value
+type crackedPassword struct {
+	Plaintext string `json:"plaintext"`
+	Origin    string `json:"origin"`
+}
+
+// johnTags are format prefixes John the Ripper adds to hashes in its potfile
+// that don't appear in the hashes stored in the record table
+var johnTags = []string{"$NT$", "$dynamic_0$", "$dynamic_26$"}
+
+// normalizeHash returns the key a hash is stored under in the potfile store:
+// hex digests are lowercased, everything else is case-sensitive
+func normalizeHash(hash string) string {
+	for _, tag := range johnTags {
+		hash = strings.TrimPrefix(hash, tag)
+	}
+	if _, err := hex.DecodeString(hash); err == nil {
+		return strings.ToLower(hash)
+	}
+	return hash
+}
+
+// parsePotfileLine splits a hashcat or John potfile line into hash and
+// plaintext. Lines whose hash isn't one of hashFormats are rejected, as are
+// salted formats that store "hash:salt", since the split is ambiguous.
+func parsePotfileLine(line string) (hash, plaintext string, ok bool) {
+	hash, plaintext, ok = strings.Cut(line, ":")
+	if !ok {
+		return "", "", false
+	}
+	hash = normalizeHash(hash)
+	if hash == "" || classifyPassword(hash) == hashTypePlaintext {
+		return "", "", false
+	}
+
+	// both tools write plaintexts containing separators or non-printable
+	// bytes as $HEX[...], so another separator means the digest was salted
+	if strings.Contains(plaintext, ":") {
+		return "", "", false
+	}
+	if strings.HasPrefix(plaintext, "$HEX[") && strings.HasSuffix(plaintext, "]") {
+		decoded, err := hex.DecodeString(plaintext[5 : len(plaintext)-1])
+		if err != nil {
+			return "", "", false
+		}
+		plaintext = string(decoded)
+	}
+	return hash, plaintext, true
+}
+
+func runImportPotfile(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: passdb import-potfile <potfile>...")
+	}
+
+	// import into a copy that replaces the store once it's complete, so the
+	// server keeps answering from the old one in the meantime
+	tmp, err := os.CreateTemp(filepath.Dir(potfileDBPath), filepath.Base(potfileDBPath)+".importing-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	err = copyPotfileDB(tmp, potfileDBPath)
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to copy potfile database: %w", err)
+	}
+
+	db, err := bbolt.Open(tmpPath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open potfile database: %w", err)
+	}
+	for _, path := range args {
+		imported, skipped, err := importPotfile(db, path)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		log.Printf("Imported %d hashes from %s (%d lines skipped)", imported, path, skipped)
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, potfileDBPath)
+}
+
+// copyPotfileDB copies the current potfile store, if there is one, into dst
+func copyPotfileDB(dst *os.File, path string) error {
+	src, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func importPotfile(db *bbolt.DB, path string) (imported, skipped int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	origin := fmt.Sprintf("potfile:%s", filepath.Base(path))
+	batch := make(map[string][]byte, potfileBatchSize)
+
+	flush := func() error {
+		err := db.Update(func(tx *bbolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(potfileBucket))
+			if err != nil {
+				return err
+			}
+			for hash, value := range batch {
+				if err := bucket.Put([]byte(hash), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		imported += len(batch)
+		clear(batch)
+		return err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		hash, plaintext, ok := parsePotfileLine(strings.TrimRight(scanner.Text(), "\r"))
+		if !ok {
+			skipped++
+			continue
+		}
+
+		value, err := json.Marshal(crackedPassword{Plaintext: plaintext, Origin: origin})
+		if err != nil {
+			return imported, skipped, err
+		}
+		batch[hash] = value
+
+		if len(batch) >= potfileBatchSize {
+			if err := flush(); err != nil {
+				return imported, skipped, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return imported, skipped, err
+	}
+	return imported, skipped, flush()
+}
+
+var potfiles = &readOnlyDB{path: potfileDBPath}
+
+// crackRecords fills in the cracked plaintext of hashed records from the
+// potfile store
+func crackRecords(records []*record) {
+	var hashed []*record
+	for _, rec := range records {
+		if rec.HashType != "" && rec.HashType != hashTypePlaintext {
+			hashed = append(hashed, rec)
+		}
+	}
+	if len(hashed) == 0 {
+		return
+	}
+
+	err := potfiles.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(potfileBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		for _, rec := range hashed {
+			data := bucket.Get([]byte(normalizeHash(rec.Password.StringVal)))
+			if data == nil {
+				continue
+			}
+			cracked := &crackedPassword{}
+			if err := json.Unmarshal(data, cracked); err != nil {
+				return err
+			}
+			rec.Cracked = cracked
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to read potfile database: %v", err)
+	}
+}
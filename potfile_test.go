@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const passwordMD5 = "5f4dcc3b5aa765d61d8327deb882cf99"
+
+func TestNormalizeHash(t *testing.T) {
+	tests := []struct {
+		hash, want string
+	}{
+		{"5F4DCC3B5AA765D61D8327DEB882CF99", passwordMD5},
+		{"$dynamic_0$5F4DCC3B5AA765D61D8327DEB882CF99", passwordMD5},
+		{"$NT$8846F7EAEE8FB117AD06BDD830B7586C", "8846f7eaee8fb117ad06bdd830b7586c"},
+		{"*2470C0C06DEE42FD1618BB99005ADCA2EC9D1E19", "*2470C0C06DEE42FD1618BB99005ADCA2EC9D1E19"},
+		{"$1$salt$qJH7.N4xYta3aEG/dfqo/0", "$1$salt$qJH7.N4xYta3aEG/dfqo/0"},
+	}
+	for _, test := range tests {
+		if got := normalizeHash(test.hash); got != test.want {
+			t.Errorf("normalizeHash(%q) = %q, want %q", test.hash, got, test.want)
+		}
+	}
+}
+
+func TestParsePotfileLine(t *testing.T) {
+	tests := []struct {
+		line            string
+		hash, plaintext string
+		ok              bool
+	}{
+		{passwordMD5 + ":password", passwordMD5, "password", true},
+		{"5F4DCC3B5AA765D61D8327DEB882CF99:password", passwordMD5, "password", true},
+		{"$NT$8846F7EAEE8FB117AD06BDD830B7586C:password", "8846f7eaee8fb117ad06bdd830b7586c", "password", true},
+		{"$dynamic_0$" + passwordMD5 + ":password", passwordMD5, "password", true},
+		{"$1$salt$qJH7.N4xYta3aEG/dfqo/0:password", "$1$salt$qJH7.N4xYta3aEG/dfqo/0", "password", true},
+		{passwordMD5 + ":$HEX[613a62]", passwordMD5, "a:b", true},
+		{passwordMD5 + ":$HEX[00ff]", passwordMD5, "\x00\xff", true},
+		{"d41d8cd98f00b204e9800998ecf8427e:", "d41d8cd98f00b204e9800998ecf8427e", "", true},
+
+		// salted md5($pass.$salt)
+		{passwordMD5 + ":s4lt:password", "", "", false},
+		{passwordMD5 + ":$HEX[zz]", "", "", false},
+		{"notahash:password", "", "", false},
+		{":password", "", "", false},
+		{passwordMD5, "", "", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		hash, plaintext, ok := parsePotfileLine(test.line)
+		if hash != test.hash || plaintext != test.plaintext || ok != test.ok {
+			t.Errorf("parsePotfileLine(%q) = %q, %q, %v, want %q, %q, %v",
+				test.line, hash, plaintext, ok, test.hash, test.plaintext, test.ok)
+		}
+	}
+}
+
+func TestImportPotfileCountsSkippedLines(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hashcat.potfile")
+	lines := passwordMD5 + ":password\r\n" +
+		passwordMD5 + ":s4lt:password\n" +
+		"not a potfile line\n" +
+		"$NT$8846F7EAEE8FB117AD06BDD830B7586C:password\n"
+	if err := os.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := bbolt.Open(filepath.Join(dir, "potfile.db"), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	imported, skipped, err := importPotfile(db, path)
+	if err != nil || imported != 2 || skipped != 2 {
+		t.Fatalf("imported %d, skipped %d, %v, want 2 and 2", imported, skipped, err)
+	}
+	db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket([]byte(potfileBucket)).Get([]byte(passwordMD5))
+		if want := `{"plaintext":"password","origin":"potfile:hashcat.potfile"}`; string(value) != want {
+			t.Errorf("stored %s, want %s", value, want)
+		}
+		return nil
+	})
+}
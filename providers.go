@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/audibleblink/passdb/hibp"
+)
+
+var (
+	providersConfigPath    = os.Getenv("BREACH_PROVIDERS_CONFIG")
+	defaultProviderTimeout = getEnvDuration("BREACH_PROVIDER_TIMEOUT", 10*time.Second)
+
+	// breachProviders are queried in order; earlier providers win when
+	// merged breaches disagree
+	breachProviders []BreachProvider
+)
+
+// BreachProvider is a source of breach intelligence. Lookups that find
+// nothing return an empty result rather than an error; Breach returns
+// hibp.ErrNotFound for unknown names.
+type BreachProvider interface {
+	Name() string
+	Timeout() time.Duration
+	BreachesByEmail(ctx context.Context, email string) ([]hibp.BreachModel, error)
+	BreachesByDomain(ctx context.Context, domain string) ([]hibp.BreachModel, error)
+	Breach(ctx context.Context, name string) (*hibp.BreachModel, error)
+}
+
+// providerBreach is a breach merged from one or more providers
+type providerBreach struct {
+	hibp.BreachModel
+	Sources []string
+}
+
+// hibpProvider serves breaches from HIBP, with breach details and domain
+// lookups answered from the local breach catalog when it's available
+type hibpProvider struct {
+	timeout time.Duration
+}
+
+func (p hibpProvider) Name() string           { return "hibp" }
+func (p hibpProvider) Timeout() time.Duration { return p.timeout }
+
+func (p hibpProvider) BreachesByEmail(ctx context.Context, email string) ([]hibp.BreachModel, error) {
+	return breachedAccount(ctx, email)
+}
+
+func (p hibpProvider) BreachesByDomain(ctx context.Context, domain string) ([]hibp.BreachModel, error) {
+	return domainBreaches(ctx, domain)
+}
+
+func (p hibpProvider) Breach(ctx context.Context, name string) (*hibp.BreachModel, error) {
+	return lookupBreach(ctx, name)
+}
+
+// httpProviderConfig configures an additional provider reached over HTTP.
+// URLs contain an {email}, {domain} or {name} placeholder and must return a
+// JSON array of breaches (a single breach for BreachURL) using the field
+// names of the HIBP breach model; a 404 means no results. Leave a URL empty
+// if the provider doesn't support that lookup.
+type httpProviderConfig struct {
+	Name      string            `json:"name"`
+	EmailURL  string            `json:"email_url"`
+	DomainURL string            `json:"domain_url"`
+	BreachURL string            `json:"breach_url"`
+	Headers   map[string]string `json:"headers"`
+	Timeout   string            `json:"timeout"`
+}
+
+type httpProvider struct {
+	config  httpProviderConfig
+	timeout time.Duration
+	client  *http.Client
+}
+
+func (p *httpProvider) Name() string           { return p.config.Name }
+func (p *httpProvider) Timeout() time.Duration { return p.timeout }
+
+func (p *httpProvider) BreachesByEmail(ctx context.Context, email string) ([]hibp.BreachModel, error) {
+	return p.list(ctx, p.config.EmailURL, "{email}", email)
+}
+
+func (p *httpProvider) BreachesByDomain(ctx context.Context, domain string) ([]hibp.BreachModel, error) {
+	return p.list(ctx, p.config.DomainURL, "{domain}", domain)
+}
+
+func (p *httpProvider) Breach(ctx context.Context, name string) (*hibp.BreachModel, error) {
+	if p.config.BreachURL == "" {
+		return nil, hibp.ErrNotFound
+	}
+	breach := &hibp.BreachModel{}
+	if err := p.get(ctx, p.config.BreachURL, "{name}", name, breach); err != nil {
+		return nil, err
+	}
+	return breach, nil
+}
+
+func (p *httpProvider) list(ctx context.Context, template, placeholder, value string) ([]hibp.BreachModel, error) {
+	breaches := make([]hibp.BreachModel, 0)
+	if template == "" {
+		return breaches, nil
+	}
+	err := p.get(ctx, template, placeholder, value, &breaches)
+	if errors.Is(err, hibp.ErrNotFound) {
+		return breaches, nil
+	}
+	return breaches, err
+}
+
+func (p *httpProvider) get(ctx context.Context, template, placeholder, value string, v interface{}) error {
+	target := strings.ReplaceAll(template, placeholder, url.PathEscape(value))
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return err
+	}
+	for key, value := range p.config.Headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return hibp.ErrNotFound
+	default:
+		return fmt.Errorf("%s: unexpected response %s", p.config.Name, res.Status)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// loadBreachProviders sets up HIBP and any providers listed in the JSON file
+// at BREACH_PROVIDERS_CONFIG
+func loadBreachProviders() error {
+	breachProviders = []BreachProvider{hibpProvider{timeout: defaultProviderTimeout}}
+	if providersConfigPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(providersConfigPath)
+	if err != nil {
+		return err
+	}
+	var configs []httpProviderConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("invalid breach providers config: %w", err)
+	}
+
+	for _, config := range configs {
+		if config.Name == "" {
+			return fmt.Errorf("invalid breach providers config: provider without a name")
+		}
+		timeout := defaultProviderTimeout
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil {
+				return fmt.Errorf("invalid timeout for provider %s: %w", config.Name, err)
+			}
+		}
+		breachProviders = append(breachProviders, &httpProvider{
+			config:  config,
+			timeout: timeout,
+			client:  &http.Client{},
+		})
+	}
+	return nil
+}
+
+// providerErrors records which providers failed during a fan-out lookup
+type providerErrors map[string]error
+
+// names returns the failed providers in a stable order for a response header
+func (errs providerErrors) names() string {
+	var names []string
+	for _, provider := range breachProviders {
+		if _, failed := errs[provider.Name()]; failed {
+			names = append(names, provider.Name())
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// reportProviderErrors lists the providers that failed while others answered
+// in the X-Breach-Provider-Errors header, and keeps the partial result out of
+// the cache
+func reportProviderErrors(w http.ResponseWriter, failed providerErrors) {
+	if len(failed) > 0 {
+		w.Header().Set("X-Breach-Provider-Errors", failed.names())
+		w.Header().Set("Cache-Control", "no-store")
+	}
+}
+
+// fanOut calls lookup for every provider concurrently, each bounded by its own
+// timeout, and merges the results. It only fails if every provider does.
+func fanOut(
+	ctx context.Context,
+	lookup func(ctx context.Context, provider BreachProvider) ([]hibp.BreachModel, error),
+) ([]*providerBreach, providerErrors, error) {
+	results := make([][]hibp.BreachModel, len(breachProviders))
+	errs := make([]error, len(breachProviders))
+
+	var wg sync.WaitGroup
+	for i, provider := range breachProviders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, provider.Timeout())
+			defer cancel()
+			results[i], errs[i] = lookup(ctx, provider)
+		}()
+	}
+	wg.Wait()
+
+	failed := make(providerErrors)
+	var merged []*providerBreach
+	index := make(map[string]*providerBreach)
+	for i, provider := range breachProviders {
+		if errs[i] != nil {
+			log.Printf("Breach provider %s failed: %v", provider.Name(), errs[i])
+			failed[provider.Name()] = errs[i]
+			continue
+		}
+		for _, breach := range results[i] {
+			key := breachKey(breach)
+			if existing, ok := index[key]; ok {
+				mergeBreach(existing, breach, provider.Name())
+				continue
+			}
+			merged = append(merged, &providerBreach{
+				BreachModel: breach,
+				Sources:     []string{provider.Name()},
+			})
+			index[key] = merged[len(merged)-1]
+		}
+	}
+
+	if len(failed) == len(breachProviders) {
+		return nil, failed, errs[0]
+	}
+	return merged, failed, nil
+}
+
+// breachKey identifies the same breach across providers, which may name it
+// differently, by the breached domain and date when both are known
+func breachKey(breach hibp.BreachModel) string {
+	if breach.Domain != "" && breach.BreachDate != "" {
+		return strings.ToLower(breach.Domain) + "|" + breach.BreachDate
+	}
+	if breach.Name != "" {
+		return strings.ToLower(breach.Name)
+	}
+	return strings.ToLower(breach.Title)
+}
+
+// mergeBreach fills in fields missing from existing with those from another
+// provider's copy of the same breach
+func mergeBreach(existing *providerBreach, breach hibp.BreachModel, source string) {
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fill(&existing.Name, breach.Name)
+	fill(&existing.Title, breach.Title)
+	fill(&existing.Domain, breach.Domain)
+	fill(&existing.BreachDate, breach.BreachDate)
+	fill(&existing.AddedDate, breach.AddedDate)
+	fill(&existing.Description, breach.Description)
+	fill(&existing.LogoPath, breach.LogoPath)
+	if existing.PwnCount == 0 {
+		existing.PwnCount = breach.PwnCount
+	}
+
+	seen := make(map[string]bool)
+	for _, dataClass := range existing.DataClasses {
+		seen[dataClass] = true
+	}
+	for _, dataClass := range breach.DataClasses {
+		if !seen[dataClass] {
+			existing.DataClasses = append(existing.DataClasses, dataClass)
+		}
+	}
+
+	existing.IsVerified = existing.IsVerified || breach.IsVerified
+	existing.Sources = append(existing.Sources, source)
+}
+
+// breachesByEmail merges every provider's breaches for email
+func breachesByEmail(ctx context.Context, email string) ([]*providerBreach, providerErrors, error) {
+	return fanOut(ctx, func(ctx context.Context, provider BreachProvider) ([]hibp.BreachModel, error) {
+		return provider.BreachesByEmail(ctx, email)
+	})
+}
+
+// breachesByDomain merges every provider's breaches of the site at domain
+func breachesByDomain(ctx context.Context, domain string) ([]*providerBreach, providerErrors, error) {
+	return fanOut(ctx, func(ctx context.Context, provider BreachProvider) ([]hibp.BreachModel, error) {
+		return provider.BreachesByDomain(ctx, domain)
+	})
+}
+
+// providerBreachByName asks each provider in order for the breach called name
+func providerBreachByName(ctx context.Context, name string) (*providerBreach, error) {
+	var firstErr error
+	for _, provider := range breachProviders {
+		lookupCtx, cancel := context.WithTimeout(ctx, provider.Timeout())
+		breach, err := provider.Breach(lookupCtx, name)
+		cancel()
+
+		if err == nil {
+			return &providerBreach{BreachModel: *breach, Sources: []string{provider.Name()}}, nil
+		}
+		if !errors.Is(err, hibp.ErrNotFound) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, hibp.ErrNotFound
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/audibleblink/passdb/hibp"
+)
+
+// stubProvider answers lookups with fixed breaches after an optional delay
+type stubProvider struct {
+	name     string
+	timeout  time.Duration
+	delay    time.Duration
+	breaches []hibp.BreachModel
+	err      error
+}
+
+func (p stubProvider) Name() string           { return p.name }
+func (p stubProvider) Timeout() time.Duration { return p.timeout }
+
+func (p stubProvider) BreachesByEmail(ctx context.Context, email string) ([]hibp.BreachModel, error) {
+	select {
+	case <-time.After(p.delay):
+		return p.breaches, p.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p stubProvider) BreachesByDomain(ctx context.Context, domain string) ([]hibp.BreachModel, error) {
+	return p.BreachesByEmail(ctx, domain)
+}
+
+func (p stubProvider) Breach(ctx context.Context, name string) (*hibp.BreachModel, error) {
+	return nil, hibp.ErrNotFound
+}
+
+// useProviders replaces the configured breach providers for the test
+func useProviders(t *testing.T, providers ...BreachProvider) {
+	t.Helper()
+	previous := breachProviders
+	breachProviders = providers
+	t.Cleanup(func() { breachProviders = previous })
+}
+
+// newHTTPProvider returns a provider for a stand-in API served by handler
+func newHTTPProvider(t *testing.T, handler http.HandlerFunc) *httpProvider {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &httpProvider{
+		config: httpProviderConfig{
+			Name:      "stand-in",
+			EmailURL:  server.URL + "/email/{email}",
+			DomainURL: server.URL + "/domain/{domain}?full=1",
+			BreachURL: server.URL + "/breach/{name}",
+			Headers:   map[string]string{"Authorization": "Bearer test-token"},
+		},
+		timeout: time.Second,
+		client:  &http.Client{},
+	}
+}
+
+func TestHTTPProviderRequests(t *testing.T) {
+	var paths []string
+	provider := newHTTPProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+			t.Errorf("Authorization = %q", got)
+		}
+		paths = append(paths, r.URL.EscapedPath()+"?"+r.URL.RawQuery)
+		if r.URL.Path == "/breach/Adobe" {
+			w.Write([]byte(`{"Name":"Adobe"}`))
+			return
+		}
+		w.Write([]byte(`[{"Name":"Adobe","Domain":"adobe.com"}]`))
+	})
+	ctx := context.Background()
+
+	breaches, err := provider.BreachesByEmail(ctx, "a/b@example.com")
+	if err != nil || len(breaches) != 1 || breaches[0].Domain != "adobe.com" {
+		t.Errorf("BreachesByEmail = %+v, %v", breaches, err)
+	}
+	if _, err := provider.BreachesByDomain(ctx, "adobe.com"); err != nil {
+		t.Error(err)
+	}
+	breach, err := provider.Breach(ctx, "Adobe")
+	if err != nil || breach.Name != "Adobe" {
+		t.Errorf("Breach = %+v, %v", breach, err)
+	}
+
+	want := []string{"/email/a%2Fb@example.com?", "/domain/adobe.com?full=1", "/breach/Adobe?"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("requested %v, want %v", paths, want)
+	}
+}
+
+func TestHTTPProviderNotFound(t *testing.T) {
+	provider := newHTTPProvider(t, http.NotFound)
+	ctx := context.Background()
+
+	breaches, err := provider.BreachesByEmail(ctx, "test@example.com")
+	if err != nil || breaches == nil || len(breaches) != 0 {
+		t.Errorf("BreachesByEmail = %#v, %v, want an empty result", breaches, err)
+	}
+	if _, err := provider.Breach(ctx, "Missing"); !errors.Is(err, hibp.ErrNotFound) {
+		t.Errorf("Breach err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestHTTPProviderErrors(t *testing.T) {
+	provider := newHTTPProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	if _, err := provider.BreachesByEmail(context.Background(), "test@example.com"); err == nil {
+		t.Error("expected an error for a 500 response")
+	}
+}
+
+func TestHTTPProviderUnsupportedLookups(t *testing.T) {
+	provider := &httpProvider{config: httpProviderConfig{Name: "emails-only"}, client: &http.Client{}}
+
+	breaches, err := provider.BreachesByDomain(context.Background(), "adobe.com")
+	if err != nil || len(breaches) != 0 {
+		t.Errorf("BreachesByDomain = %+v, %v, want an empty result", breaches, err)
+	}
+	if _, err := provider.Breach(context.Background(), "Adobe"); !errors.Is(err, hibp.ErrNotFound) {
+		t.Errorf("Breach err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestFanOutTimesOutSlowProviders(t *testing.T) {
+	slow := newHTTPProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	slow.timeout = 50 * time.Millisecond
+	useProviders(t,
+		stubProvider{name: "fast", timeout: time.Second, breaches: []hibp.BreachModel{{Name: "Adobe"}}},
+		slow,
+	)
+
+	start := time.Now()
+	breaches, failed, err := breachesByEmail(context.Background(), "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("fan-out took %s, want it bounded by the slow provider's timeout", waited)
+	}
+	if len(breaches) != 1 || breaches[0].Name != "Adobe" {
+		t.Errorf("got %+v, want the fast provider's breach", breaches)
+	}
+	if !errors.Is(failed["stand-in"], context.DeadlineExceeded) || failed.names() != "stand-in" {
+		t.Errorf("failed = %v, want the slow provider timed out", failed)
+	}
+}
+
+func TestFanOutFailsWhenEveryProviderFails(t *testing.T) {
+	useProviders(t,
+		stubProvider{name: "first", timeout: time.Second, err: hibp.ErrForbidden},
+		stubProvider{name: "second", timeout: time.Second, err: errors.New("down")},
+	)
+
+	_, failed, err := breachesByDomain(context.Background(), "adobe.com")
+	if !errors.Is(err, hibp.ErrForbidden) {
+		t.Errorf("err = %v, want the first provider's error", err)
+	}
+	if failed.names() != "first,second" {
+		t.Errorf("failed = %q", failed.names())
+	}
+}
+
+func TestFanOutMergesByBreachKey(t *testing.T) {
+	useProviders(t,
+		stubProvider{name: "hibp", timeout: time.Second, breaches: []hibp.BreachModel{
+			{Name: "Adobe", Domain: "adobe.com", BreachDate: "2013-10-04", DataClasses: []string{"Passwords"}},
+			{Name: "Dropbox"},
+		}},
+		stubProvider{name: "other", timeout: time.Second, breaches: []hibp.BreachModel{
+			{Name: "adobe-2013", Domain: "Adobe.com", BreachDate: "2013-10-04", Description: "Leaked",
+				PwnCount: 152445165, IsVerified: true, DataClasses: []string{"Passwords", "Usernames"}},
+			{Name: "dropbox"},
+			{Name: "Adobe", Domain: "adobe.com", BreachDate: "2019-01-01"},
+		}},
+	)
+
+	breaches, failed, err := breachesByEmail(context.Background(), "test@example.com")
+	if err != nil || len(failed) != 0 {
+		t.Fatalf("err = %v, failed = %v", err, failed)
+	}
+	if len(breaches) != 3 {
+		t.Fatalf("got %d breaches, want Adobe, Dropbox and the later Adobe breach", len(breaches))
+	}
+
+	adobe := breaches[0]
+	if adobe.Name != "Adobe" || adobe.Description != "Leaked" || adobe.PwnCount != 152445165 || !adobe.IsVerified {
+		t.Errorf("Adobe = %+v, want HIBP's name with the other fields filled in", adobe)
+	}
+	if !reflect.DeepEqual(adobe.DataClasses, []string{"Passwords", "Usernames"}) {
+		t.Errorf("Adobe data classes = %v", adobe.DataClasses)
+	}
+	if !reflect.DeepEqual(adobe.Sources, []string{"hibp", "other"}) {
+		t.Errorf("Adobe sources = %v", adobe.Sources)
+	}
+	if !reflect.DeepEqual(breaches[1].Sources, []string{"hibp", "other"}) {
+		t.Errorf("Dropbox sources = %v, want names matched case-insensitively", breaches[1].Sources)
+	}
+	if !reflect.DeepEqual(breaches[2].Sources, []string{"other"}) {
+		t.Errorf("later Adobe breach sources = %v, want it kept apart", breaches[2].Sources)
+	}
+}
+
+func TestFilteredBreachesMarksPartialResultsNoStore(t *testing.T) {
+	useProviders(t,
+		stubProvider{name: "hibp", timeout: time.Second, breaches: []hibp.BreachModel{{Name: "Adobe"}}},
+		stubProvider{name: "other", timeout: time.Second, err: errors.New("down")},
+	)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v1/breaches/test@example.com", nil)
+	breaches, ok := filteredBreaches(rec, req, func(ctx context.Context) ([]*providerBreach, providerErrors, error) {
+		return breachesByEmail(ctx, "test@example.com")
+	})
+	if !ok || len(breaches) != 1 {
+		t.Fatalf("got %+v, %v", breaches, ok)
+	}
+	if got := rec.Header().Get("X-Breach-Provider-Errors"); got != "other" {
+		t.Errorf("X-Breach-Provider-Errors = %q, want other", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+}
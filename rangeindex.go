@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/go-chi/chi"
+	"go.etcd.io/bbolt"
+)
+
+var rangeDBPath = getEnv("RANGE_DB_PATH", "./range.db")
+
+const (
+	rangeBucket    = "range"
+	rangeBatchSize = 100000
+
+	// padded responses are topped up with fake zero-count suffixes to a
+	// random size in this range, as the Pwned Passwords API does
+	rangePaddingMin = 800
+	rangePaddingMax = 1000
+)
+
+var rangePrefixPattern = regexp.MustCompile(`^[0-9A-Fa-f]{5}$`)
+
+// runBuildRangeIndex builds the SHA1 range index from every plaintext password
+// in the record table. The index is written to a temporary file and moved into
+// place when complete, so a running server keeps answering from the old one.
+func runBuildRangeIndex(args []string) error {
+	if err := connectBigQuery(); err != nil {
+		return err
+	}
+
+	tmpPath := rangeDBPath + ".building"
+	os.Remove(tmpPath)
+	db, err := bbolt.Open(tmpPath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to create range index: %w", err)
+	}
+
+	// prefix -> suffix -> count
+	batch := make(map[string]map[string]int64)
+	batched := 0
+	var total int64
+
+	flush := func() error {
+		err := db.Update(func(tx *bbolt.Tx) error {
+			root, err := tx.CreateBucketIfNotExists([]byte(rangeBucket))
+			if err != nil {
+				return err
+			}
+			for prefix, suffixes := range batch {
+				bucket, err := root.CreateBucketIfNotExists([]byte(prefix))
+				if err != nil {
+					return err
+				}
+				for suffix, count := range suffixes {
+					if existing := bucket.Get([]byte(suffix)); existing != nil {
+						count += int64(binary.BigEndian.Uint64(existing))
+					}
+					value := make([]byte, 8)
+					binary.BigEndian.PutUint64(value, uint64(count))
+					if err := bucket.Put([]byte(suffix), value); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		clear(batch)
+		batched = 0
+		return err
+	}
+
+	err = distinctPasswords(context.Background(), "", func(password string, count int64) error {
+		if classifyPassword(password) != hashTypePlaintext {
+			return nil
+		}
+
+		prefix, suffix := sha1Range(password)
+		if batch[prefix] == nil {
+			batch[prefix] = make(map[string]int64)
+		}
+		batch[prefix][suffix] += count
+		batched++
+		total++
+
+		if batched >= rangeBatchSize {
+			log.Printf("Indexed %d passwords", total)
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	log.Printf("Indexed %d passwords into %s", total, rangeDBPath)
+	return os.Rename(tmpPath, rangeDBPath)
+}
+
+// distinctPasswords calls fn with every distinct non-empty password in the
+// record table, or only those for domain when it is set, and the number of
+// records it appears in
+func distinctPasswords(ctx context.Context, domain string, fn func(password string, count int64) error) error {
+	query := passwordsQuery(`password, COUNT(*) AS count`, domain, `GROUP BY password`)
+
+	var row struct {
+		Password string `bigquery:"password"`
+		Count    int64  `bigquery:"count"`
+	}
+	var fnErr error
+	err := readRows(ctx, query, &row, func() {
+		if fnErr == nil {
+			fnErr = fn(row.Password, row.Count)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// passwordsQuery selects columns from the records with a non-empty password,
+// scoped to domain when it is set
+func passwordsQuery(columns, domain, suffix string) *bigquery.Query {
+	where := `password IS NOT NULL AND password != ''`
+	params := map[string]string{}
+	if domain != "" {
+		where += ` AND domain = @domain`
+		params["domain"] = domain
+	}
+
+	queryString := fmt.Sprintf(`SELECT %s FROM %s WHERE %s %s`, columns, bigQueryTable, where, suffix)
+	return parameterize(queryString, params)
+}
+
+// sha1Range returns the 5 character prefix and 35 character suffix of the
+// uppercase hex SHA1 of password
+func sha1Range(password string) (prefix, suffix string) {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	return digest[:5], digest[5:]
+}
+
+func handleRange(w http.ResponseWriter, r *http.Request) {
+	prefix := chi.URLParam(r, "prefix")
+	if !rangePrefixPattern.MatchString(prefix) {
+		JSONError(w, fmt.Errorf("prefix must be 5 hexadecimal characters"), http.StatusBadRequest)
+		return
+	}
+	prefix = strings.ToUpper(prefix)
+
+	suffixes, err := rangeSuffixes(prefix)
+	if os.IsNotExist(err) {
+		JSONError(w, fmt.Errorf("range index has not been built"), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		JSONError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if padding, _ := strconv.ParseBool(r.Header.Get("Add-Padding")); padding {
+		suffixes = padRange(suffixes)
+	}
+
+	lines := make([]string, 0, len(suffixes))
+	for suffix, count := range suffixes {
+		lines = append(lines, fmt.Sprintf("%s:%d", suffix, count))
+	}
+	sort.Strings(lines)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(strings.Join(lines, "\r\n")))
+}
+
+// rangeIndex is the index built by build-range-index, opened at startup
+var rangeIndex = &readOnlyDB{path: rangeDBPath}
+
+func rangeSuffixes(prefix string) (map[string]int64, error) {
+	suffixes := make(map[string]int64)
+	err := rangeIndex.View(func(tx *bbolt.Tx) error {
+		root := tx.Bucket([]byte(rangeBucket))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(prefix))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			suffixes[string(k)] = int64(binary.BigEndian.Uint64(v))
+			return nil
+		})
+	})
+	return suffixes, err
+}
+
+// padRange adds random zero-count suffixes so the response size doesn't
+// reveal how many real suffixes share the prefix
+func padRange(suffixes map[string]int64) map[string]int64 {
+	target := rangePaddingMin + rand.IntN(rangePaddingMax-rangePaddingMin+1)
+	for len(suffixes) < target {
+		fake := make([]byte, 18)
+		for i := range fake {
+			fake[i] = byte(rand.UintN(256))
+		}
+		suffix := strings.ToUpper(hex.EncodeToString(fake))[:35]
+		if _, exists := suffixes[suffix]; !exists {
+			suffixes[suffix] = 0
+		}
+	}
+	return suffixes
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// readOnlyDB holds a bbolt database that's built offline, such as the range
+// index or potfile store, open read-only. Builds replace the file with a
+// rename, so each read checks whether a new one has been swapped in.
+type readOnlyDB struct {
+	mu   sync.RWMutex
+	path string
+	db   *bbolt.DB
+	file os.FileInfo
+}
+
+// View runs fn against the current database. It fails with a not-exist
+// error if the database hasn't been built.
+func (s *readOnlyDB) View(fn func(tx *bbolt.Tx) error) error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	current := s.db != nil && os.SameFile(s.file, info)
+	s.mu.RUnlock()
+	if !current {
+		if err := s.reopen(info); err != nil {
+			return err
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.View(fn)
+}
+
+// open opens the database ahead of the first read, if it has been built
+func (s *readOnlyDB) open() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	return s.reopen(info)
+}
+
+func (s *readOnlyDB) reopen(info os.FileInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil && os.SameFile(s.file, info) {
+		return nil
+	}
+
+	db, err := bbolt.Open(s.path, 0600, &bbolt.Options{
+		Timeout:  1 * time.Second,
+		ReadOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+	if s.db != nil {
+		s.db.Close()
+	}
+	s.db, s.file = db, info
+	return nil
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// strength is a zxcvbn-style estimate of how hard a password is to guess
+type strength struct {
+	Score            int      `json:"score"`
+	Guesses          float64  `json:"guesses"`
+	GuessesLog10     float64  `json:"guesses_log10"`
+	Patterns         []string `json:"patterns"`
+	ContainsUsername bool     `json:"contains_username"`
+	ContainsDomain   bool     `json:"contains_domain"`
+}
+
+// match is a substring of the password explained by a single pattern
+type match struct {
+	pattern string
+	i, j    int // inclusive rune offsets
+	guesses float64
+}
+
+const (
+	patternDictionary   = "dictionary"
+	patternL33t         = "l33t"
+	patternKeyboardWalk = "keyboard_walk"
+	patternSequence     = "sequence"
+	patternRepeat       = "repeat"
+	patternDate         = "date"
+	patternUserInput    = "user_input"
+	patternBruteforce   = "bruteforce"
+
+	minYear = 1900
+	maxYear = 2049
+
+	// maxScoredRunes bounds the work spent on a password; anything past it is
+	// already uncrackable, so the rest isn't scored
+	maxScoredRunes = 100
+	// maxGuessesLog10 keeps guesses within what a float64, and JSON, can hold
+	maxGuessesLog10 = 300
+)
+
+// commonPasswords is ordered by frequency; the index is used as the guess rank
+var commonPasswords = []string{
+	"123456", "password", "12345678", "qwerty", "123456789", "12345", "1234",
+	"111111", "1234567", "dragon", "123123", "baseball", "abc123", "football",
+	"monkey", "letmein", "696969", "shadow", "master", "666666", "qwertyuiop",
+	"123321", "mustang", "1234567890", "michael", "654321", "superman",
+	"1qaz2wsx", "7777777", "121212", "000000", "qazwsx", "123qwe", "killer",
+	"trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter", "buster",
+	"soccer", "harley", "batman", "andrew", "tigger", "sunshine", "iloveyou",
+	"2000", "charlie", "robert", "thomas", "hockey", "ranger", "daniel",
+	"starwars", "klaster", "112233", "george", "computer", "michelle",
+	"jessica", "pepper", "1111", "zxcvbn", "555555", "11111111", "131313",
+	"freedom", "777777", "pass", "maggie", "159753", "aaaaaa", "ginger",
+	"princess", "joshua", "cheese", "amanda", "summer", "love", "ashley",
+	"nicole", "chelsea", "biteme", "matthew", "access", "yankees", "987654321",
+	"dallas", "austin", "thunder", "taylor", "matrix", "welcome", "admin",
+	"login", "secret", "changeme", "winter", "spring", "autumn", "hello",
+	"flower", "orange", "purple", "banana", "cookie", "chocolate", "passw0rd",
+	"whatever", "qwerty123", "monday", "friday", "money", "family", "angel",
+	"lovely", "baby", "god", "blessed", "default", "guest", "root", "test",
+	"company", "office", "service", "support", "internet", "server", "database",
+}
+
+var commonPasswordRank = func() map[string]int {
+	ranks := make(map[string]int, len(commonPasswords))
+	for i, word := range commonPasswords {
+		ranks[word] = i + 1
+	}
+	return ranks
+}()
+
+var l33tTable = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i',
+	'!': 'i', '|': 'l', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't',
+	'2': 'z',
+}
+
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+var keyboardAdjacency = func() map[rune]map[rune]bool {
+	type pos struct{ row, col int }
+	positions := make(map[rune]pos)
+	for row, keys := range keyboardRows {
+		for col, key := range keys {
+			positions[key] = pos{row, col}
+		}
+	}
+
+	adjacency := make(map[rune]map[rune]bool)
+	for a, pa := range positions {
+		adjacency[a] = make(map[rune]bool)
+		for b, pb := range positions {
+			dr, dc := pa.row-pb.row, pa.col-pb.col
+			// rows are staggered, so a key touches the one up-and-right of it
+			// and the one down-and-left of it, but not the other diagonals
+			near := (dr == 0 && (dc == 1 || dc == -1)) ||
+				(dr == 1 && (dc == 0 || dc == -1)) ||
+				(dr == -1 && (dc == 0 || dc == 1))
+			if near {
+				adjacency[a][b] = true
+			}
+		}
+	}
+	return adjacency
+}()
+
+var (
+	yearPattern = regexp.MustCompile(`(19|20)\d\d`)
+	datePattern = regexp.MustCompile(
+		`(\d{1,4})([\s/\\_.-]?)(\d{1,2})([\s/\\_.-]?)(\d{1,4})`,
+	)
+)
+
+// scorePassword estimates the strength of password; username and domain are
+// treated as known inputs an attacker would try first.
+func scorePassword(password, username, domain string) *strength {
+	runes := []rune(password)
+	if len(runes) > maxScoredRunes {
+		runes = runes[:maxScoredRunes]
+	}
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	userInputs := userInputWords(username, domain)
+	matches := dictionaryMatches(lower, userInputs)
+	matches = append(matches, l33tMatches(lower, userInputs)...)
+	matches = append(matches, keyboardMatches(lower)...)
+	matches = append(matches, sequenceMatches(lower)...)
+	matches = append(matches, repeatMatches(lower)...)
+	matches = append(matches, dateMatches(string(lower))...)
+
+	for k := range matches {
+		m := &matches[k]
+		if string(runes[m.i:m.j+1]) != string(lower[m.i:m.j+1]) {
+			// capitalized variants of a known pattern
+			m.guesses *= 2
+		}
+	}
+
+	log10Guesses, used := minimumGuesses(runes, matches)
+	log10Guesses = math.Min(log10Guesses, maxGuessesLog10)
+	guesses := math.Pow(10, log10Guesses)
+	s := &strength{
+		Guesses:      math.Round(guesses),
+		GuessesLog10: math.Round(log10Guesses*100) / 100,
+		Score:        guessesToScore(guesses),
+		Patterns:     make([]string, 0),
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range used {
+		if !seen[m.pattern] {
+			seen[m.pattern] = true
+			s.Patterns = append(s.Patterns, m.pattern)
+		}
+	}
+	sort.Strings(s.Patterns)
+
+	lowerPassword := strings.ToLower(password)
+	if u := strings.ToLower(username); len(u) >= 3 {
+		s.ContainsUsername = strings.Contains(lowerPassword, u)
+	}
+	if label := domainLabel(domain); len(label) >= 3 {
+		s.ContainsDomain = strings.Contains(lowerPassword, label)
+	}
+	return s
+}
+
+func userInputWords(username, domain string) map[string]bool {
+	words := make(map[string]bool)
+	if u := strings.ToLower(username); len(u) >= 3 {
+		words[u] = true
+	}
+	if label := domainLabel(domain); len(label) >= 3 {
+		words[label] = true
+	}
+	return words
+}
+
+// domainLabel returns the registrable label of a domain, e.g. "example" for
+// "mail.example.com"
+func domainLabel(domain string) string {
+	labels := strings.Split(strings.ToLower(domain), ".")
+	if len(labels) < 2 {
+		return labels[0]
+	}
+	return labels[len(labels)-2]
+}
+
+func dictionaryMatches(lower []rune, userInputs map[string]bool) (matches []match) {
+	for i := range lower {
+		for j := i + 2; j < len(lower); j++ {
+			word := string(lower[i : j+1])
+			if userInputs[word] {
+				matches = append(matches, match{patternUserInput, i, j, 1})
+			}
+			if rank, ok := commonPasswordRank[word]; ok {
+				matches = append(matches, match{patternDictionary, i, j, float64(rank)})
+			}
+		}
+	}
+	return
+}
+
+func l33tMatches(lower []rune, userInputs map[string]bool) (matches []match) {
+	unsubbed := make([]rune, len(lower))
+	substituted := false
+	for i, r := range lower {
+		if plain, ok := l33tTable[r]; ok {
+			unsubbed[i] = plain
+			substituted = true
+		} else {
+			unsubbed[i] = r
+		}
+	}
+	if !substituted {
+		return nil
+	}
+
+	for _, m := range dictionaryMatches(unsubbed, userInputs) {
+		subs := 0
+		for k := m.i; k <= m.j; k++ {
+			if unsubbed[k] != lower[k] {
+				subs++
+			}
+		}
+		if subs == 0 {
+			continue
+		}
+		// each substitution roughly doubles the variations an attacker tries
+		m.pattern = patternL33t
+		m.guesses *= math.Pow(2, float64(subs))
+		matches = append(matches, m)
+	}
+	return
+}
+
+func keyboardMatches(lower []rune) (matches []match) {
+	start := 0
+	for k := 1; k <= len(lower); k++ {
+		if k < len(lower) && keyboardAdjacency[lower[k-1]][lower[k]] {
+			continue
+		}
+		if length := k - start; length >= 4 {
+			// ~94 starting keys, ~4 neighbours per step
+			guesses := 94 * math.Pow(4, float64(length-1))
+			matches = append(matches, match{patternKeyboardWalk, start, k - 1, guesses})
+		}
+		start = k
+	}
+	return
+}
+
+func sequenceMatches(lower []rune) (matches []match) {
+	start := 0
+	for k := 1; k <= len(lower); k++ {
+		if k < len(lower) {
+			delta := lower[k] - lower[k-1]
+			steady := k == start+1 || delta == lower[start+1]-lower[start]
+			if (delta == 1 || delta == -1) && steady {
+				continue
+			}
+		}
+		if length := k - start; length >= 3 {
+			base := 26.0
+			if unicode.IsDigit(lower[start]) {
+				base = 10
+			}
+			matches = append(matches, match{patternSequence, start, k - 1, base * float64(length)})
+		}
+		start = k
+	}
+	return
+}
+
+func repeatMatches(lower []rune) (matches []match) {
+	start := 0
+	for k := 1; k <= len(lower); k++ {
+		if k < len(lower) && lower[k] == lower[start] {
+			continue
+		}
+		if length := k - start; length >= 3 {
+			matches = append(matches, match{patternRepeat, start, k - 1, 95 * float64(length)})
+		}
+		start = k
+	}
+	return
+}
+
+func dateMatches(lower string) (matches []match) {
+	// regexp offsets are in bytes; dates are ASCII so map them back to runes
+	// relative to the start of the string
+	offsets := runeOffsets(lower)
+
+	for _, loc := range yearPattern.FindAllStringIndex(lower, -1) {
+		matches = append(matches, match{
+			patternDate, offsets[loc[0]], offsets[loc[1]] - 1, maxYear - minYear,
+		})
+	}
+
+	for _, loc := range datePattern.FindAllStringSubmatchIndex(lower, -1) {
+		day, month, year := lower[loc[2]:loc[3]], lower[loc[6]:loc[7]], lower[loc[10]:loc[11]]
+		if len(day) == 4 {
+			// year-first layout, e.g. 1999-12-31
+			day, year = year, day
+		}
+		if !plausibleDate(day, month, year) {
+			continue
+		}
+		guesses := 365.0 * (maxYear - minYear)
+		if loc[4] != loc[5] {
+			guesses *= 4 // separator choice
+		}
+		matches = append(matches, match{patternDate, offsets[loc[0]], offsets[loc[1]] - 1, guesses})
+	}
+	return
+}
+
+func runeOffsets(s string) map[int]int {
+	offsets := make(map[int]int, len(s)+1)
+	n := 0
+	for i := range s {
+		offsets[i] = n
+		n++
+	}
+	offsets[len(s)] = n
+	return offsets
+}
+
+func plausibleDate(day, month, year string) bool {
+	d, m, y := atoi(day), atoi(month), atoi(year)
+	if d > 12 && m > 12 {
+		return false
+	}
+	if d < 1 || d > 31 || m < 1 || m > 31 {
+		return false
+	}
+	switch len(year) {
+	case 2:
+		return true
+	case 4:
+		return y >= minYear && y <= maxYear
+	}
+	return false
+}
+
+func atoi(s string) int {
+	n := 0
+	for _, r := range s {
+		n = n*10 + int(r-'0')
+	}
+	return n
+}
+
+// minimumGuesses finds the sequence of non-overlapping matches, filled in with
+// bruteforce characters, that minimizes the total guess count, returned as
+// log10(guesses)
+func minimumGuesses(runes []rune, matches []match) (float64, []match) {
+	n := len(runes)
+	if n == 0 {
+		return 0, nil
+	}
+	cardinality := math.Log10(bruteforceCardinality(runes))
+
+	// best[k] is the lowest log10(guesses) to produce the first k runes
+	best := make([]float64, n+1)
+	prev := make([]int, n+1)
+	via := make([]*match, n+1)
+	byEnd := make(map[int][]match)
+	for _, m := range matches {
+		byEnd[m.j] = append(byEnd[m.j], m)
+	}
+	for k := 1; k <= n; k++ {
+		best[k] = best[k-1] + cardinality
+		prev[k], via[k] = k-1, nil
+		for idx := range byEnd[k-1] {
+			m := byEnd[k-1][idx]
+			if cost := best[m.i] + math.Log10(math.Max(m.guesses, 1)); cost < best[k] {
+				best[k], prev[k], via[k] = cost, m.i, &m
+			}
+		}
+	}
+
+	var used []match
+	bruteforced := false
+	for k := n; k > 0; k = prev[k] {
+		if via[k] != nil {
+			used = append(used, *via[k])
+		} else {
+			bruteforced = true
+		}
+	}
+	if bruteforced {
+		used = append(used, match{pattern: patternBruteforce})
+	}
+	return best[n], used
+}
+
+func bruteforceCardinality(runes []rune) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	cardinality := 0.0
+	if lower {
+		cardinality += 26
+	}
+	if upper {
+		cardinality += 26
+	}
+	if digit {
+		cardinality += 10
+	}
+	if symbol {
+		cardinality += 33
+	}
+	if other {
+		cardinality += 100
+	}
+	return cardinality
+}
+
+func guessesToScore(guesses float64) int {
+	switch {
+	case guesses < 1e3:
+		return 0
+	case guesses < 1e6:
+		return 1
+	case guesses < 1e8:
+		return 2
+	case guesses < 1e10:
+		return 3
+	}
+	return 4
+}
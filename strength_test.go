@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestScorePassword(t *testing.T) {
+	tests := []struct {
+		password, username, domain string
+		wantPattern                string
+		minScore, maxScore         int
+	}{
+		{"password", "", "", patternDictionary, 0, 0},
+		{"PASSWORD", "", "", patternDictionary, 0, 0},
+		{"p@ssw0rd", "", "", patternL33t, 0, 0},
+		{"sdfghj", "", "", patternKeyboardWalk, 1, 1},
+		{"1999-12-31", "", "", patternDate, 1, 2},
+		{"abcdef", "", "", patternSequence, 0, 0},
+		{"zzzzzz", "", "", patternRepeat, 0, 0},
+		{"jsmith", "jsmith", "", patternUserInput, 0, 0},
+		{"examplecorp", "", "mail.example.com", patternUserInput, 0, 3},
+		{"x7#Kq9!vLm2$Wp", "", "", patternBruteforce, 4, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.password, func(t *testing.T) {
+			s := scorePassword(test.password, test.username, test.domain)
+			if !slices.Contains(s.Patterns, test.wantPattern) {
+				t.Errorf("patterns = %v, want %s", s.Patterns, test.wantPattern)
+			}
+			if s.Score < test.minScore || s.Score > test.maxScore {
+				t.Errorf("score = %d (%g guesses), want %d to %d", s.Score, s.Guesses, test.minScore, test.maxScore)
+			}
+		})
+	}
+}
+
+func TestScorePasswordUserInputs(t *testing.T) {
+	s := scorePassword("Jsmith@Example1", "jsmith", "example.com")
+	if !s.ContainsUsername || !s.ContainsDomain {
+		t.Errorf("ContainsUsername %v, ContainsDomain %v, want both", s.ContainsUsername, s.ContainsDomain)
+	}
+	if s := scorePassword("jsmith", "js", "x.io"); s.ContainsUsername || s.ContainsDomain {
+		t.Errorf("inputs shorter than three characters were matched: %+v", s)
+	}
+}
+
+func TestScorePasswordLongInput(t *testing.T) {
+	password := strings.Repeat("aB3$", 250)
+	s := scorePassword(password, "", "")
+	if math.IsInf(s.Guesses, 0) || math.IsNaN(s.Guesses) || s.GuessesLog10 > maxGuessesLog10 {
+		t.Errorf("guesses = %g (log10 %g), want a finite count", s.Guesses, s.GuessesLog10)
+	}
+	if s.Score != 4 {
+		t.Errorf("score = %d, want 4", s.Score)
+	}
+	if _, err := json.Marshal(s); err != nil {
+		t.Errorf("marshal: %v", err)
+	}
+
+	// the username is still found past the scored prefix
+	if s := scorePassword(password+"jsmith", "jsmith", ""); !s.ContainsUsername {
+		t.Error("username past the scored prefix wasn't found")
+	}
+}
+
+func TestGuessesToScore(t *testing.T) {
+	tests := []struct {
+		guesses float64
+		want    int
+	}{
+		{1, 0},
+		{999, 0},
+		{1e3, 1},
+		{1e6 - 1, 1},
+		{1e6, 2},
+		{1e8, 3},
+		{1e10 - 1, 3},
+		{1e10, 4},
+		{1e300, 4},
+	}
+	for _, test := range tests {
+		if got := guessesToScore(test.guesses); got != test.want {
+			t.Errorf("guessesToScore(%g) = %d, want %d", test.guesses, got, test.want)
+		}
+	}
+}
+
+func TestMinimumGuesses(t *testing.T) {
+	word := match{patternDictionary, 0, 7, 2}
+	tests := []struct {
+		name         string
+		password     string
+		matches      []match
+		wantLog10    float64
+		wantPatterns []string
+	}{
+		{"empty", "", nil, 0, nil},
+		{"bruteforce", "abc", nil, 3 * math.Log10(26), []string{patternBruteforce}},
+		{"whole match", "password", []match{word}, math.Log10(2), []string{patternDictionary}},
+		{"match and bruteforce", "password1", []match{word}, math.Log10(2) + math.Log10(36), []string{patternDictionary, patternBruteforce}},
+		{
+			// the dictionary word beats the two shorter matches covering it
+			"cheapest cover", "password",
+			[]match{word, {patternRepeat, 0, 3, 1e6}, {patternSequence, 4, 7, 1e6}},
+			math.Log10(2), []string{patternDictionary},
+		},
+		{"bruteforce beats a costly match", "ab", []match{{patternDate, 0, 1, 1e9}}, 2 * math.Log10(26), []string{patternBruteforce}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, used := minimumGuesses([]rune(test.password), test.matches)
+			if math.Abs(got-test.wantLog10) > 1e-9 {
+				t.Errorf("log10 guesses = %g, want %g", got, test.wantLog10)
+			}
+			var patterns []string
+			for _, m := range used {
+				patterns = append(patterns, m.pattern)
+			}
+			if !slices.Equal(patterns, test.wantPatterns) {
+				t.Errorf("used %v, want %v", patterns, test.wantPatterns)
+			}
+		})
+	}
+}
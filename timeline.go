@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/audibleblink/passdb/hibp"
+	"github.com/go-chi/chi"
+)
+
+// Optional provenance columns of the records table. When set, local hits are
+// grouped by the dump they came from and dated by when it was imported;
+// otherwise they appear as a single undated event.
+var (
+	recordSourceColumn = os.Getenv("RECORD_SOURCE_COLUMN")
+	recordDateColumn   = os.Getenv("RECORD_DATE_COLUMN")
+)
+
+// Types of timeline events
+const (
+	eventBreach = "breach"
+	eventPaste  = "paste"
+	eventRecord = "record"
+)
+
+// timelineEvent is a single exposure of an email, dated by the breach, the
+// paste, or the import of the dump it was found in
+type timelineEvent struct {
+	Date              string   `json:"date,omitempty"`
+	Type              string   `json:"type"`
+	Source            string   `json:"source"`
+	Title             string   `json:"title,omitempty"`
+	DataClasses       []string `json:"data_classes"`
+	PasswordAvailable bool     `json:"password_available"`
+	Records           int      `json:"records,omitempty"`
+	Providers         []string `json:"providers,omitempty"`
+}
+
+// localHit is a group of records for an email that share a source and date
+type localHit struct {
+	source    string
+	date      string
+	records   int
+	passwords int
+}
+
+func handleTimeline(w http.ResponseWriter, r *http.Request) {
+	email := chi.URLParam(r, "email")
+	username, domain, ok := strings.Cut(email, "@")
+	if !ok || username == "" || domain == "" {
+		JSONError(w, fmt.Errorf("invalid email format"), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		wg                            sync.WaitGroup
+		breaches                      []*providerBreach
+		failed                        providerErrors
+		pastes                        []hibp.PasteModel
+		hits                          []*localHit
+		breachErr, pasteErr, localErr error
+	)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		breaches, failed, breachErr = breachesByEmail(r.Context(), email)
+	}()
+	go func() {
+		defer wg.Done()
+		pastes, pasteErr = hibpClient.PasteAccount(r.Context(), email)
+		if errors.Is(pasteErr, hibp.ErrNotFound) {
+			pasteErr = nil
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		hits, localErr = localHits(r.Context(), username, domain)
+	}()
+	wg.Wait()
+
+	if localErr != nil {
+		JSONError(w, localErr, http.StatusInternalServerError)
+		return
+	}
+	for _, err := range []error{breachErr, pasteErr} {
+		if err != nil {
+			hibpError(w, err)
+			return
+		}
+	}
+	reportProviderErrors(w, failed)
+
+	jsonWriter(w, buildTimeline(breaches, pastes, hits))
+}
+
+// buildTimeline merges breaches, pastes and local hits into events ordered
+// by date, with undated events last. Breaches without a usable breach date
+// are dated by when HIBP added them.
+func buildTimeline(breaches []*providerBreach, pastes []hibp.PasteModel, hits []*localHit) []timelineEvent {
+	// local sources that match a breach by name or domain mean a password
+	// for that breach is available locally
+	withPasswords := make(map[string]bool)
+	for _, hit := range hits {
+		if hit.passwords > 0 && hit.source != "" {
+			withPasswords[strings.ToLower(hit.source)] = true
+		}
+	}
+
+	events := make([]timelineEvent, 0, len(breaches)+len(pastes)+len(hits))
+	for _, breach := range breaches {
+		dataClasses := breach.DataClasses
+		if dataClasses == nil {
+			dataClasses = []string{}
+		}
+		date := eventDate(breach.BreachDate)
+		if date == "" {
+			date = eventDate(breach.AddedDate)
+		}
+		events = append(events, timelineEvent{
+			Date:        date,
+			Type:        eventBreach,
+			Source:      breach.Name,
+			Title:       breach.Title,
+			DataClasses: dataClasses,
+			PasswordAvailable: withPasswords[strings.ToLower(breach.Name)] ||
+				(breach.Domain != "" && withPasswords[strings.ToLower(breach.Domain)]),
+			Providers: breach.Sources,
+		})
+	}
+
+	for _, paste := range pastes {
+		events = append(events, timelineEvent{
+			Date:        eventDate(paste.Date),
+			Type:        eventPaste,
+			Source:      paste.Source + ":" + paste.ID,
+			Title:       paste.Title,
+			DataClasses: []string{"Email addresses"},
+		})
+	}
+
+	for _, hit := range hits {
+		source := hit.source
+		if source == "" {
+			source = "local"
+		}
+		dataClasses := []string{"Email addresses", "Usernames"}
+		if hit.passwords > 0 {
+			dataClasses = append(dataClasses, "Passwords")
+		}
+		events = append(events, timelineEvent{
+			Date:              hit.date,
+			Type:              eventRecord,
+			Source:            source,
+			DataClasses:       dataClasses,
+			PasswordAvailable: hit.passwords > 0,
+			Records:           hit.records,
+		})
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Date == "" || events[j].Date == "" {
+			return events[j].Date == "" && events[i].Date != ""
+		}
+		return events[i].Date < events[j].Date
+	})
+	return events
+}
+
+// localHits counts the records for an email, grouped by the provenance
+// columns when they are configured
+func localHits(ctx context.Context, username, domain string) ([]*localHit, error) {
+	source, date := "''", "''"
+	if recordSourceColumn != "" {
+		source = fmt.Sprintf("IFNULL(CAST(%s AS STRING), '')", recordSourceColumn)
+	}
+	if recordDateColumn != "" {
+		date = fmt.Sprintf("IFNULL(CAST(%s AS STRING), '')", recordDateColumn)
+	}
+
+	query := parameterize(fmt.Sprintf(
+		`SELECT %s AS source, %s AS date, COUNT(*) AS records,
+			COUNTIF(IFNULL(password, '') != '') AS passwords
+		FROM %s WHERE username = @username AND domain = @domain
+		GROUP BY source, date`,
+		source,
+		date,
+		bigQueryTable,
+	), map[string]string{"username": username, "domain": domain})
+
+	var row struct {
+		Source    bigquery.NullString `bigquery:"source"`
+		Date      bigquery.NullString `bigquery:"date"`
+		Records   int64               `bigquery:"records"`
+		Passwords int64               `bigquery:"passwords"`
+	}
+	var hits []*localHit
+	err := readRows(ctx, query, &row, func() {
+		hits = append(hits, &localHit{
+			source:    row.Source.StringVal,
+			date:      eventDate(row.Date.StringVal),
+			records:   int(row.Records),
+			passwords: int(row.Passwords),
+		})
+	})
+	return hits, err
+}
+
+// eventDate reduces a date or timestamp, as HIBP and BigQuery format them, to
+// YYYY-MM-DD so events sort chronologically
+func eventDate(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) < len("2006-01-02") {
+		return ""
+	}
+	if _, err := time.Parse(time.DateOnly, value[:10]); err != nil {
+		return ""
+	}
+	return value[:10]
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/audibleblink/passdb/hibp"
+)
+
+func TestEventDate(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"2013-10-04", "2013-10-04"},
+		{"2013-10-04T00:00:00Z", "2013-10-04"},
+		{" 2013-10-04 12:00:00 UTC ", "2013-10-04"},
+		{"", ""},
+		{"2013-10", ""},
+		{"2013-13-04", ""},
+		{"unknown date", ""},
+	}
+	for _, test := range tests {
+		if got := eventDate(test.value); got != test.want {
+			t.Errorf("eventDate(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestBuildTimeline(t *testing.T) {
+	breach := func(name, breachDate, addedDate string) *providerBreach {
+		return &providerBreach{BreachModel: hibp.BreachModel{
+			Name:       name,
+			BreachDate: breachDate,
+			AddedDate:  addedDate,
+		}}
+	}
+
+	tests := []struct {
+		name     string
+		breaches []*providerBreach
+		pastes   []hibp.PasteModel
+		hits     []*localHit
+		want     []string
+	}{
+		{
+			name: "ordered by date",
+			breaches: []*providerBreach{
+				breach("Later", "2019-01-01", ""),
+				breach("Earlier", "2012-06-05", ""),
+			},
+			pastes: []hibp.PasteModel{{Source: "Pastebin", ID: "x", Date: "2015-03-01T10:00:00Z"}},
+			want:   []string{"2012-06-05 Earlier", "2015-03-01 Pastebin:x", "2019-01-01 Later"},
+		},
+		{
+			name: "missing breach date falls back to added date",
+			breaches: []*providerBreach{
+				breach("Missing", "", "2016-05-01T00:00:00Z"),
+				breach("Dated", "2014-01-01", "2020-01-01T00:00:00Z"),
+			},
+			want: []string{"2014-01-01 Dated", "2016-05-01 Missing"},
+		},
+		{
+			name: "invalid breach date falls back to added date",
+			breaches: []*providerBreach{
+				breach("Invalid", "sometime in 2010", "2011-02-03T00:00:00Z"),
+			},
+			want: []string{"2011-02-03 Invalid"},
+		},
+		{
+			name: "undated events last",
+			breaches: []*providerBreach{
+				breach("Undated", "", "not a date"),
+				breach("Dated", "2014-01-01", ""),
+			},
+			pastes: []hibp.PasteModel{{Source: "Pastebin", ID: "x"}},
+			want:   []string{"2014-01-01 Dated", " Undated", " Pastebin:x"},
+		},
+		{
+			name: "breaches sharing a date keep their order",
+			breaches: []*providerBreach{
+				breach("B", "2014-01-01", ""),
+				breach("A", "2014-01-01", ""),
+			},
+			pastes: []hibp.PasteModel{{Source: "Pastebin", ID: "x", Date: "2014-01-01T00:00:00Z"}},
+			hits:   []*localHit{{source: "dump", date: "2014-01-01", records: 1}},
+			want:   []string{"2014-01-01 B", "2014-01-01 A", "2014-01-01 Pastebin:x", "2014-01-01 dump"},
+		},
+		{
+			name: "local-only hits",
+			hits: []*localHit{
+				{records: 3},
+				{source: "combo", date: "2018-07-01", records: 2, passwords: 2},
+			},
+			want: []string{"2018-07-01 combo", " local"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, event := range buildTimeline(test.breaches, test.pastes, test.hits) {
+				got = append(got, event.Date+" "+event.Source)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got  %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildTimelineLocalHits(t *testing.T) {
+	breaches := []*providerBreach{
+		{BreachModel: hibp.BreachModel{Name: "Adobe", Domain: "adobe.com", BreachDate: "2013-10-04"}},
+		{BreachModel: hibp.BreachModel{Name: "LinkedIn", Domain: "linkedin.com", BreachDate: "2012-05-05"}},
+		{BreachModel: hibp.BreachModel{Name: "Dropbox", BreachDate: "2012-07-01"}},
+	}
+	hits := []*localHit{
+		{source: "ADOBE", records: 2, passwords: 1},
+		{source: "linkedin.com", records: 1},
+		{records: 4, passwords: 4},
+	}
+	events := buildTimeline(breaches, nil, hits)
+
+	available := make(map[string]bool)
+	for _, event := range events {
+		if event.Type == eventBreach {
+			available[event.Source] = event.PasswordAvailable
+		}
+	}
+	want := map[string]bool{"Adobe": true, "LinkedIn": false, "Dropbox": false}
+	if !reflect.DeepEqual(available, want) {
+		t.Errorf("password_available = %v, want %v", available, want)
+	}
+
+	local := events[len(events)-1]
+	if local.Type != eventRecord || local.Source != "local" || local.Records != 4 || !local.PasswordAvailable {
+		t.Errorf("local hit = %+v", local)
+	}
+	if want := []string{"Email addresses", "Usernames", "Passwords"}; !reflect.DeepEqual(local.DataClasses, want) {
+		t.Errorf("local hit data classes = %q, want %q", local.DataClasses, want)
+	}
+	for _, event := range events {
+		if event.DataClasses == nil {
+			t.Errorf("%s has null data classes", event.Source)
+		}
+	}
+}
+
+func TestFailedProviderIsNotCached(t *testing.T) {
+	useProviders(t,
+		stubProvider{name: "ok", timeout: time.Second, breaches: []hibp.BreachModel{{Name: "Adobe", BreachDate: "2013-10-04"}}},
+		stubProvider{name: "broken", timeout: time.Second, err: errors.New("unavailable")},
+	)
+
+	calls := 0
+	handler := useCache(t, testCacheConfig(), func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		breaches, failed, err := breachesByEmail(r.Context(), "user@example.com")
+		if err != nil {
+			hibpError(w, err)
+			return
+		}
+		reportProviderErrors(w, failed)
+		jsonWriter(w, buildTimeline(breaches, nil, nil))
+	})
+
+	for range 2 {
+		rec := get(handler, "/api/v1/timeline/user@example.com")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("X-Breach-Provider-Errors"); got != "broken" {
+			t.Errorf("X-Breach-Provider-Errors = %q, want broken", got)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("Cache-Control = %q, want no-store", got)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want the partial timeline left uncached", calls)
+	}
+}